@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+// activeJob is a sr.ht job submitted by hottub which is still being
+// monitored.
+type activeJob struct {
+	installationID int64
+	id             int32
+	srht           *SrhtClient
+	cancel         context.CancelFunc
+	missingGrant   string // grant required by the job but missing from the token
+
+	// protected by activeJobSet.mutex
+	status    buildssrht.JobStatus
+	cancelled bool
+}
+
+type activeJobSet struct {
+	mutex sync.Mutex
+	jobs  map[*activeJob]struct{}
+}
+
+func newActiveJobSet() *activeJobSet {
+	return &activeJobSet{jobs: make(map[*activeJob]struct{})}
+}
+
+func (set *activeJobSet) add(job *activeJob) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	job.status = buildssrht.JobStatusPending
+	set.jobs[job] = struct{}{}
+}
+
+func (set *activeJobSet) remove(job *activeJob) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	delete(set.jobs, job)
+}
+
+func (set *activeJobSet) setStatus(job *activeJob, status buildssrht.JobStatus) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	job.status = status
+}
+
+// has returns true if a job is being monitored.
+func (set *activeJobSet) has(id int32) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	for job := range set.jobs {
+		if job.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// countByInstallation returns the number of jobs being monitored for each
+// installation.
+func (set *activeJobSet) countByInstallation() map[int64]int {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	counts := make(map[int64]int)
+	for job := range set.jobs {
+		counts[job.installationID]++
+	}
+	return counts
+}
+
+// isCancelled returns true if monitoring of the job has been stopped via
+// cancelInstallation.
+func (set *activeJobSet) isCancelled(job *activeJob) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return job.cancelled
+}
+
+// cancelInstallation stops monitoring all jobs belonging to an installation,
+// and cancels the ones which haven't started running yet.
+func (set *activeJobSet) cancelInstallation(ctx context.Context, installationID int64) {
+	var queued []*activeJob
+	set.mutex.Lock()
+	for job := range set.jobs {
+		if job.installationID != installationID {
+			continue
+		}
+		job.cancelled = true
+		job.cancel()
+		switch job.status {
+		case buildssrht.JobStatusPending, buildssrht.JobStatusQueued:
+			queued = append(queued, job)
+		}
+	}
+	set.mutex.Unlock()
+
+	for _, job := range queued {
+		if _, err := buildssrht.CancelJob(job.srht.GQL, ctx, job.id); err != nil {
+			log.Printf("failed to cancel sr.ht job #%v: %v", job.id, err)
+		} else {
+			log.Printf("cancelled sr.ht job #%v for installation %v", job.id, installationID)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// adminDeadDeliveries is the number of failed webhook deliveries
+	// displayed on the admin page.
+	adminDeadDeliveries = 20
+	// adminRecentJobsWindow is the period over which recent job submissions
+	// are counted.
+	adminRecentJobsWindow = 24 * time.Hour
+)
+
+type adminInstallation struct {
+	*Installation
+	SrhtAccounts []srhtAccountStatus
+	ActiveJobs   int
+	Jobs         JobCounts
+}
+
+// parseAdmins parses a comma-separated list of GitHub logins.
+func parseAdmins(s string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, login := range strings.Split(s, ",") {
+		login = strings.TrimSpace(login)
+		if login != "" {
+			admins[strings.ToLower(login)] = true
+		}
+	}
+	return admins
+}
+
+// requireAdmin returns the session of the user performing the request if they
+// are an administrator of this instance. Otherwise, it writes an error and
+// returns nil.
+func (srv *Server) requireAdmin(w http.ResponseWriter, r *http.Request) *Session {
+	if len(srv.admins) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+	session := srv.requireSession(w, r)
+	if session == nil {
+		return nil
+	}
+	if !srv.admins[strings.ToLower(session.GitHubLogin)] {
+		http.Error(w, "only administrators can access this page", http.StatusForbidden)
+		return nil
+	}
+	return session
+}
+
+func (srv *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	session := srv.requireAdmin(w, r)
+	if session == nil {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !checkCSRFToken(r) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		srv.handleAdminDisable(w, r, session)
+		return
+	}
+
+	installations, err := srv.db.ListInstallations()
+	if err != nil {
+		log.Printf("failed to list installations: %v", err)
+		http.Error(w, "failed to list installations", http.StatusInternalServerError)
+		return
+	}
+	jobCounts, err := srv.db.CountJobs(time.Now().Add(-adminRecentJobsWindow))
+	if err != nil {
+		log.Printf("failed to count jobs: %v", err)
+		http.Error(w, "failed to count jobs", http.StatusInternalServerError)
+		return
+	}
+	queueDepth, err := srv.db.CountQueuedDeliveries()
+	if err != nil {
+		log.Printf("failed to count queued webhook deliveries: %v", err)
+		http.Error(w, "failed to count queued webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	dead, err := srv.db.ListDeadDeliveries()
+	if err != nil {
+		log.Printf("failed to list dead webhook deliveries: %v", err)
+		http.Error(w, "failed to list dead webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	// Most recent failures first
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].ID > dead[j].ID
+	})
+	deadCount := len(dead)
+	if len(dead) > adminDeadDeliveries {
+		dead = dead[:adminDeadDeliveries]
+	}
+
+	activeCounts := activeJobs.countByInstallation()
+	var items []*adminInstallation
+	var activeTotal int
+	for _, installation := range installations {
+		item := &adminInstallation{
+			Installation: installation,
+			SrhtAccounts: listSrhtAccounts(installation),
+			ActiveJobs:   activeCounts[installation.ID],
+		}
+		if c := jobCounts[installation.ID]; c != nil {
+			item.Jobs = *c
+		}
+		activeTotal += item.ActiveJobs
+		items = append(items, item)
+	}
+
+	data := struct {
+		Session        *Session
+		Installations  []*adminInstallation
+		ActiveJobs     int
+		QueueDepth     int
+		DeadDeliveries []*Delivery
+		DeadCount      int
+		CSRFToken      string
+	}{
+		Session:        session,
+		Installations:  items,
+		ActiveJobs:     activeTotal,
+		QueueDepth:     queueDepth,
+		DeadDeliveries: dead,
+		DeadCount:      deadCount,
+		CSRFToken:      csrfToken(r),
+	}
+	srv.renderTemplate(w, "admin.html", &data)
+}
+
+// handleAdminExport streams an export of the DB. Unlike the "db export"
+// command, it doesn't require the server to be stopped.
+func (srv *Server) handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	session := srv.requireAdmin(w, r)
+	if session == nil {
+		return
+	}
+
+	redact := r.URL.Query().Get("redact") != ""
+	filename := fmt.Sprintf("hottub-%v.export", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// The response has already started if the export fails mid-way, so the
+	// error can only be logged
+	n, err := srv.db.Export(w, redact)
+	if err != nil {
+		log.Printf("failed to export DB for %v: %v", session.GitHubLogin, err)
+		return
+	}
+	log.Printf("DB exported by %v (%v records)", session.GitHubLogin, n)
+}
+
+// handleAdminDisable disables or re-enables an installation.
+func (srv *Server) handleAdminDisable(w http.ResponseWriter, r *http.Request, session *Session) {
+	id, err := strconv.ParseInt(r.PostFormValue("installation_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid installation ID", http.StatusBadRequest)
+		return
+	}
+	disabled := r.PostFormValue("disabled") != ""
+
+	err = srv.db.UpdateInstallation(id, func(installation *Installation) error {
+		installation.Disabled = disabled
+		return nil
+	})
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("failed to update installation %v: %v", id, err)
+		http.Error(w, "failed to update installation", http.StatusInternalServerError)
+		return
+	}
+
+	if disabled {
+		log.Printf("installation %v disabled by %v", id, session.GitHubLogin)
+		activeJobs.cancelInstallation(r.Context(), id)
+	} else {
+		log.Printf("installation %v enabled by %v", id, session.GitHubLogin)
+		if err := srv.resumeJobs(r.Context(), id); err != nil {
+			log.Printf("failed to resume jobs of installation %v: %v", id, err)
+		}
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-github/v56/github"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+const (
+	apiDefaultLimit = 50
+	apiMaxLimit     = 200
+)
+
+// apiRoutes registers the JSON API. Requests are authenticated with a GitHub
+// token, and authorized according to the repository permissions of the
+// caller.
+func (srv *Server) apiRoutes(r chi.Router) {
+	r.Get("/installations", srv.handleAPIInstallations)
+	r.Get("/repos/{owner}/{repo}/jobs", srv.handleAPIRepoJobs)
+	r.Post("/repos/{owner}/{repo}/builds", srv.handleAPIRepoBuild)
+	r.Get("/repos/{owner}/{repo}/settings", srv.handleAPIRepoSettings)
+	r.Get("/jobs/{id}", srv.handleAPIJob)
+	r.Post("/jobs/{id}/cancel", srv.handleAPICancelJob)
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, v ...interface{}) {
+	writeAPIJSON(w, status, &apiError{Error: fmt.Sprintf(format, v...)})
+}
+
+// apiUser authenticates an API request with the GitHub token passed in the
+// Authorization header. It returns a GitHub client acting as the user, or nil
+// if a response has already been written.
+func apiUser(w http.ResponseWriter, r *http.Request) (*github.Client, *github.User) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if token == "" || (!strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, "token")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "missing GitHub token")
+		return nil, nil
+	}
+
+	gh := newUserClient(strings.TrimSpace(token))
+	user, resp, err := gh.Users.Get(r.Context(), "")
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "invalid GitHub token")
+		return nil, nil
+	} else if err != nil {
+		log.Printf("failed to fetch GitHub user: %v", err)
+		writeAPIError(w, http.StatusBadGateway, "failed to fetch GitHub user")
+		return nil, nil
+	}
+	return gh, user
+}
+
+// apiRepo fetches a repository on behalf of the user, and checks that the
+// user has the specified permission ("pull", "push" or "admin"). It returns
+// nil if a response has already been written.
+func apiRepo(w http.ResponseWriter, r *http.Request, gh *github.Client, owner, name, perm string) *github.Repository {
+	repo, resp, err := gh.Repositories.Get(r.Context(), owner, name)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		writeAPIError(w, http.StatusNotFound, "repository not found")
+		return nil
+	} else if err != nil {
+		log.Printf("failed to fetch repository %v/%v: %v", owner, name, err)
+		writeAPIError(w, http.StatusBadGateway, "failed to fetch repository")
+		return nil
+	}
+	if !repo.GetPermissions()[perm] {
+		writeAPIError(w, http.StatusForbidden, "%v permission required on repository %v", perm, repo.GetFullName())
+		return nil
+	}
+	return repo
+}
+
+// apiJob fetches a job and checks that the user has the specified
+// permission on its repository. It returns nil if a response has already been
+// written.
+func (srv *Server) apiJob(w http.ResponseWriter, r *http.Request, gh *github.Client, perm string) *Job {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid job ID")
+		return nil
+	}
+
+	job, err := srv.db.GetJob(int32(id))
+	if err == ErrNotFound {
+		writeAPIError(w, http.StatusNotFound, "job not found")
+		return nil
+	} else if err != nil {
+		log.Printf("failed to get job #%v: %v", id, err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to get job")
+		return nil
+	}
+
+	owner, name, _ := strings.Cut(job.Repo, "/")
+	if apiRepo(w, r, gh, owner, name, perm) == nil {
+		return nil
+	}
+	return job
+}
+
+// parseAPIJobQuery reads job filters from query parameters.
+func parseAPIJobQuery(r *http.Request) (*JobQuery, error) {
+	q := r.URL.Query()
+	query := &JobQuery{
+		Commit:   q.Get("commit"),
+		Branch:   q.Get("branch"),
+		Manifest: q.Get("manifest"),
+		Status:   q.Get("status"),
+		Limit:    apiDefaultLimit,
+	}
+	if s := q.Get("pr"); s != "" {
+		pr, err := strconv.Atoi(s)
+		if err != nil || pr <= 0 {
+			return nil, fmt.Errorf("invalid pr parameter")
+		}
+		query.PullRequest = pr
+	}
+	if s := q.Get("before"); s != "" {
+		before, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || before <= 0 {
+			return nil, fmt.Errorf("invalid before parameter")
+		}
+		query.Before = int32(before)
+	}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > apiMaxLimit {
+			return nil, fmt.Errorf("limit parameter must be a number between 1 and %v", apiMaxLimit)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+// apiInstallationView is the representation of an installation returned by
+// the API. Linked sr.ht accounts and other settings are only included for
+// users who can manage the installation.
+type apiInstallationView struct {
+	*installationView
+	CanManage bool `json:"can_manage"`
+}
+
+func (srv *Server) handleAPIInstallations(w http.ResponseWriter, r *http.Request) {
+	gh, user := apiUser(w, r)
+	if gh == nil {
+		return
+	}
+
+	ghInstallations, err := listUserInstallations(r.Context(), gh)
+	if err != nil {
+		log.Printf("failed to list installations for %v: %v", user.GetLogin(), err)
+		writeAPIError(w, http.StatusBadGateway, "failed to list installations")
+		return
+	}
+
+	views := []*apiInstallationView{}
+	for _, ghInstallation := range ghInstallations {
+		installation, err := srv.db.GetInstallation(ghInstallation.GetID())
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			log.Printf("failed to get installation %v: %v", ghInstallation.GetID(), err)
+			writeAPIError(w, http.StatusInternalServerError, "failed to get installation")
+			return
+		}
+
+		canManage, err := canManageInstallation(r.Context(), gh, user.GetLogin(), installation)
+		if err != nil {
+			log.Printf("failed to check permissions for installation %v: %v", installation.ID, err)
+			writeAPIError(w, http.StatusBadGateway, "failed to check permissions")
+			return
+		}
+
+		view := newInstallationView(installation)
+		if !canManage {
+			view = &installationView{
+				ID:        installation.ID,
+				Owner:     installation.Owner,
+				Org:       installation.Org,
+				CreatedAt: installation.CreatedAt,
+				Suspended: installation.Suspended,
+				Disabled:  installation.Disabled,
+			}
+		}
+		views = append(views, &apiInstallationView{view, canManage})
+	}
+	writeAPIJSON(w, http.StatusOK, views)
+}
+
+func (srv *Server) handleAPIRepoJobs(w http.ResponseWriter, r *http.Request) {
+	gh, _ := apiUser(w, r)
+	if gh == nil {
+		return
+	}
+	repo := apiRepo(w, r, gh, chi.URLParam(r, "owner"), chi.URLParam(r, "repo"), "pull")
+	if repo == nil {
+		return
+	}
+
+	query, err := parseAPIJobQuery(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	query.Repo = repo.GetFullName()
+
+	jobs, err := srv.db.ListJobs(query)
+	if err != nil {
+		log.Printf("failed to list jobs for repository %v: %v", repo.GetFullName(), err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to list jobs")
+		return
+	}
+	if jobs == nil {
+		jobs = []*Job{}
+	}
+	writeAPIJSON(w, http.StatusOK, jobs)
+}
+
+type apiBuildRequest struct {
+	Ref string `json:"ref"` // branch, tag or commit SHA
+}
+
+// handleAPIRepoBuild submits jobs for a ref, bypassing deduplication.
+func (srv *Server) handleAPIRepoBuild(w http.ResponseWriter, r *http.Request) {
+	gh, user := apiUser(w, r)
+	if gh == nil {
+		return
+	}
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "repo")
+	if apiRepo(w, r, gh, owner, name, "push") == nil {
+		return
+	}
+
+	var req apiBuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+	if req.Ref == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing ref")
+		return
+	}
+
+	ctx := r.Context()
+	ghInstallation, resp, err := srv.agh.Apps.FindRepositoryInstallation(ctx, owner, name)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		writeAPIError(w, http.StatusNotFound, "hottub isn't installed on this repository")
+		return
+	} else if err != nil {
+		log.Printf("failed to find installation for repository %v/%v: %v", owner, name, err)
+		writeAPIError(w, http.StatusBadGateway, "failed to find installation")
+		return
+	}
+
+	// Fetch the repository as the app, to get the same view as webhooks
+	installationGH := srv.github.installationClient(ghInstallation.GetID())
+	repo, _, err := installationGH.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		log.Printf("failed to fetch repository %v/%v: %v", owner, name, err)
+		writeAPIError(w, http.StatusBadGateway, "failed to fetch repository")
+		return
+	}
+
+	suiteCtx, err := srv.newCheckSuiteContext(ctx, ghInstallation, repo, user)
+	if err == ErrNotFound {
+		writeAPIError(w, http.StatusConflict, "installation not set up yet")
+		return
+	} else if err != nil {
+		log.Printf("failed to prepare build for %v: %v", repo.GetFullName(), err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to prepare build")
+		return
+	} else if suiteCtx == nil {
+		writeAPIError(w, http.StatusConflict, "builds are disabled for this repository")
+		return
+	}
+	suiteCtx.headRepo = repo
+	suiteCtx.forceBuild = true
+
+	if err := resolveBuildRef(suiteCtx, req.Ref); err == ErrNotFound {
+		writeAPIError(w, http.StatusNotFound, "ref %q not found", req.Ref)
+		return
+	} else if err != nil {
+		log.Printf("failed to resolve ref %q of %v: %v", req.Ref, repo.GetFullName(), err)
+		writeAPIError(w, http.StatusBadGateway, "failed to resolve ref")
+		return
+	}
+
+	if err := startCheckSuite(suiteCtx); err != nil {
+		log.Printf("failed to start build of %v for %v: %v", suiteCtx.headSHA, repo.GetFullName(), err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to start build")
+		return
+	} else if suiteCtx.failure != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "%v", suiteCtx.failure)
+		return
+	}
+	log.Printf("build of %v for %v triggered via the API by %v", suiteCtx.headSHA, repo.GetFullName(), user.GetLogin())
+
+	jobs := suiteCtx.jobs
+	if jobs == nil {
+		jobs = []*Job{}
+	}
+	writeAPIJSON(w, http.StatusCreated, jobs)
+}
+
+// resolveBuildRef populates the head commit of a check suite context from a
+// branch name, tag or commit SHA. ErrNotFound is returned if the ref doesn't
+// exist.
+func resolveBuildRef(ctx *checkSuiteContext, ref string) error {
+	owner, name := ctx.baseRepo.Owner.GetLogin(), ctx.baseRepo.GetName()
+
+	branchName := strings.TrimPrefix(ref, "refs/heads/")
+	branch, resp, err := ctx.gh.Repositories.GetBranch(ctx, owner, name, branchName, 1)
+	if err == nil {
+		ctx.headBranch = branch.GetName()
+		ctx.headSHA = branch.GetCommit().GetSHA()
+		ctx.headCommit = branch.GetCommit().GetCommit()
+		return nil
+	} else if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	repoCommit, resp, err := ctx.gh.Repositories.GetCommit(ctx, owner, name, ref, nil)
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	ctx.headSHA = repoCommit.GetSHA()
+	ctx.headCommit = repoCommit.GetCommit()
+	return nil
+}
+
+func (srv *Server) handleAPIRepoSettings(w http.ResponseWriter, r *http.Request) {
+	gh, _ := apiUser(w, r)
+	if gh == nil {
+		return
+	}
+	repo := apiRepo(w, r, gh, chi.URLParam(r, "owner"), chi.URLParam(r, "repo"), "admin")
+	if repo == nil {
+		return
+	}
+
+	settings, err := srv.db.GetRepoSettings(repo.GetID())
+	if err != nil {
+		log.Printf("failed to get settings for repository %v: %v", repo.GetFullName(), err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to get settings")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, settings)
+}
+
+func (srv *Server) handleAPIJob(w http.ResponseWriter, r *http.Request) {
+	gh, _ := apiUser(w, r)
+	if gh == nil {
+		return
+	}
+	job := srv.apiJob(w, r, gh, "pull")
+	if job == nil {
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, job)
+}
+
+func (srv *Server) handleAPICancelJob(w http.ResponseWriter, r *http.Request) {
+	gh, user := apiUser(w, r)
+	if gh == nil {
+		return
+	}
+	job := srv.apiJob(w, r, gh, "push")
+	if job == nil {
+		return
+	}
+	if !job.FinishedAt.IsZero() {
+		writeAPIError(w, http.StatusConflict, "job has already finished")
+		return
+	}
+
+	if err := srv.cancelJob(r.Context(), job); err != nil {
+		log.Printf("failed to cancel sr.ht job #%v: %v", job.ID, err)
+		writeAPIError(w, http.StatusBadGateway, "failed to cancel job")
+		return
+	}
+	log.Printf("sr.ht job #%v cancelled via the API by %v", job.ID, user.GetLogin())
+
+	writeAPIJSON(w, http.StatusOK, job)
+}
+
+// cancelJob cancels a sr.ht job with the account which submitted it, and
+// records its new status.
+func (srv *Server) cancelJob(ctx context.Context, job *Job) error {
+	srht, err := srv.jobSrhtClient(job)
+	if err != nil {
+		return err
+	}
+	if _, err := buildssrht.CancelJob(srht.GQL, ctx, job.ID); err != nil {
+		return err
+	}
+
+	if err := srv.db.UpdateJobStatus(job.ID, string(buildssrht.JobStatusCancelled), true); err != nil {
+		return fmt.Errorf("failed to update history: %v", err)
+	}
+	updated, err := srv.db.GetJob(job.ID)
+	if err != nil {
+		return err
+	}
+	*job = *updated
+	return nil
+}
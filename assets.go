@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+)
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// requiredTemplates lists the templates executed by the HTTP handlers.
+var requiredTemplates = []string{
+	"index.html",
+	"post-install.html",
+	"dashboard.html",
+	"admin.html",
+	"history.html",
+	"job.html",
+	"settings.html",
+}
+
+// overlayFS serves files from an override directory, falling back to the
+// embedded files.
+type overlayFS struct {
+	override, fallback fs.FS
+}
+
+func (fsys overlayFS) Open(name string) (fs.File, error) {
+	f, err := fsys.override.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fsys.fallback.Open(name)
+	}
+	return f, err
+}
+
+// loadAssets returns the file system to load templates or static files from.
+// Files from dir, if any, take precedence over the embedded ones.
+func loadAssets(embedded embed.FS, subdir, dir string) (fs.FS, error) {
+	fsys, err := fs.Sub(embedded, subdir)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return fsys, nil
+	}
+	if err := checkDir(dir); err != nil {
+		return nil, err
+	}
+	return overlayFS{override: os.DirFS(dir), fallback: fsys}, nil
+}
+
+func checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	return nil
+}
+
+// loadTemplates parses the embedded templates, then the templates in dir
+// which replace the embedded ones with the same name.
+func loadTemplates(dir string) (*template.Template, error) {
+	tpl, err := template.ParseFS(embeddedTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		if err := checkDir(dir); err != nil {
+			return nil, err
+		}
+		overrides, err := fs.Glob(os.DirFS(dir), "*.html")
+		if err != nil {
+			return nil, err
+		} else if len(overrides) == 0 {
+			log.Printf("no templates found in %v", dir)
+		} else if tpl, err = tpl.ParseFS(os.DirFS(dir), overrides...); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range requiredTemplates {
+		if tpl.Lookup(name) == nil {
+			return nil, fmt.Errorf("missing template %q", name)
+		}
+	}
+	return tpl, nil
+}
+
+// renderTemplate executes a template. The output is buffered, so that an
+// error page can be served if execution fails.
+func (srv *Server) renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := srv.tpl.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("failed to render template %v: %v", name, err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v56/github"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	sessionCookieName    = "hottub_session"
+	oauthStateCookieName = "hottub_oauth_state"
+	srhtStateCookieName  = "hottub_srht_oauth_state"
+	sessionDuration      = 8 * time.Hour
+)
+
+var sessionsBucket = []byte("sessions")
+
+// Session is a user logged in with GitHub.
+type Session struct {
+	GitHubLogin string    `json:"github_login"`
+	GitHubToken string    `json:"github_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// GitHub returns a GitHub client authenticated as the user.
+func (session *Session) GitHub() *github.Client {
+	return newUserClient(session.GitHubToken)
+}
+
+// CreateSession stores a new session and returns its secret token.
+func (db *DB) CreateSession(session *Session) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	key := sessionKey(token)
+
+	stored := *session
+	if db.keyring != nil {
+		stored.GitHubToken, err = db.keyring.Encrypt(session.GitHubToken, key)
+		if err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(&stored)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.DB.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put(key, b)
+	})
+	return token, err
+}
+
+// GetSession looks up a session by token. ErrNotFound is returned if the
+// session doesn't exist, has expired or can't be decrypted anymore.
+func (db *DB) GetSession(token string) (*Session, error) {
+	key := sessionKey(token)
+	var session *Session
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(sessionsBucket).Get(key)
+		if b == nil {
+			return ErrNotFound
+		}
+		session = new(Session)
+		return json.Unmarshal(b, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	if strings.HasPrefix(session.GitHubToken, encryptedPrefix) {
+		if db.keyring == nil {
+			return nil, ErrNotFound
+		}
+		session.GitHubToken, err = db.keyring.Decrypt(session.GitHubToken, key)
+		if err != nil {
+			// The key may have been retired: the user needs to log in again
+			log.Printf("failed to decrypt session: %v", err)
+			return nil, ErrNotFound
+		}
+	}
+	return session, nil
+}
+
+// ReencryptSessions re-encrypts the GitHub tokens of all sessions with the
+// primary key. Sessions which have expired or can't be decrypted are deleted.
+func (db *DB) ReencryptSessions() (reencrypted, deleted int, err error) {
+	if db.keyring == nil {
+		return 0, 0, fmt.Errorf("no encryption key configured")
+	}
+
+	now := time.Now()
+	err = db.DB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+
+		updated := make(map[string][]byte)
+		var stale [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var session Session
+			if err := json.Unmarshal(v, &session); err != nil || now.After(session.ExpiresAt) {
+				stale = append(stale, k)
+				return nil
+			}
+
+			token := session.GitHubToken
+			if strings.HasPrefix(token, encryptedPrefix) {
+				var err error
+				if token, err = db.keyring.Decrypt(token, k); err != nil {
+					stale = append(stale, k)
+					return nil
+				}
+			}
+
+			var err error
+			session.GitHubToken, err = db.keyring.Encrypt(token, k)
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(&session)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = b
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, b := range updated {
+			if err := bucket.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		reencrypted, deleted = len(updated), len(stale)
+		return nil
+	})
+	return reencrypted, deleted, err
+}
+
+func (db *DB) DeleteSession(token string) error {
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete(sessionKey(token))
+	})
+}
+
+// PruneSessions removes expired sessions.
+func (db *DB) PruneSessions() error {
+	now := time.Now()
+	return db.DB.Update(func(tx *bbolt.Tx) error {
+		return pruneBucket(tx.Bucket(sessionsBucket), func(v []byte) bool {
+			var session Session
+			return json.Unmarshal(v, &session) != nil || now.After(session.ExpiresAt)
+		})
+	})
+}
+
+// sessionKey returns the DB key for a session token. Only a hash of the token
+// is stored, so that a copy of the DB can't be used to log in.
+func sessionKey(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getSession returns the session of the user performing the request, or nil
+// if the user isn't logged in.
+func (srv *Server) getSession(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, nil
+	}
+
+	session, err := srv.db.GetSession(cookie.Value)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return session, err
+}
+
+// csrfToken returns the token which must be submitted along with forms, or an
+// empty string if the user isn't logged in. It's derived from the session
+// token, which can't be read by other sites.
+func csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("csrf:" + cookie.Value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// checkCSRFToken checks the token submitted in a POST form.
+func checkCSRFToken(r *http.Request) bool {
+	token := csrfToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue("csrf_token"))) == 1
+}
+
+// requireSession returns the session of the user performing the request. If
+// the user isn't logged in, it redirects to the login page and returns nil.
+func (srv *Server) requireSession(w http.ResponseWriter, r *http.Request) *Session {
+	session, err := srv.getSession(r)
+	if err != nil {
+		log.Printf("failed to get session: %v", err)
+		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		return nil
+	} else if session == nil {
+		q := make(url.Values)
+		q.Set("redirect", r.URL.RequestURI())
+		http.Redirect(w, r, "/login?"+q.Encode(), http.StatusFound)
+		return nil
+	}
+	return session
+}
+
+// canManageInstallation checks whether a user is allowed to manage an
+// installation: only the user who installed the app and organization admins
+// are. gh must be authenticated as the user.
+func canManageInstallation(ctx context.Context, gh *github.Client, login string, installation *Installation) (bool, error) {
+	if strings.EqualFold(login, installation.Owner) {
+		return true, nil
+	}
+	if installation.Org == "" {
+		return false, nil
+	}
+
+	membership, resp, err := gh.Organizations.GetOrgMembership(ctx, "", installation.Org)
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return membership.GetState() == "active" && membership.GetRole() == "admin", nil
+}
+
+func (srv *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	redirect := r.URL.Query().Get("redirect")
+	if !isLocalRedirect(redirect) {
+		redirect = "/"
+	}
+
+	state, err := generateToken()
+	if err != nil {
+		log.Printf("failed to generate OAuth2 state: %v", err)
+		http.Error(w, "failed to generate OAuth2 state", http.StatusInternalServerError)
+		return
+	}
+
+	cookieValue := make(url.Values)
+	cookieValue.Set("state", state)
+	cookieValue.Set("redirect", redirect)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    cookieValue.Encode(),
+		Path:     "/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, srv.ghOAuth2Client.AuthorizationURL(state), http.StatusFound)
+}
+
+func (srv *Server) handleAuthorizeGitHub(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		http.Error(w, "GitHub error: "+errCode, http.StatusForbidden)
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookieName)
+	if err != nil {
+		http.Error(w, "missing OAuth2 state cookie", http.StatusBadRequest)
+		return
+	}
+	cookieValue, _ := url.ParseQuery(cookie.Value)
+	if state := cookieValue.Get("state"); state == "" || state != q.Get("state") {
+		http.Error(w, "invalid OAuth2 state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookieName, Path: "/", MaxAge: -1})
+
+	ctx := r.Context()
+	tokenResp, err := srv.ghOAuth2Client.Exchange(ctx, q.Get("code"))
+	if err != nil {
+		log.Printf("failed to exchange GitHub code for an OAuth2 token: %v", err)
+		http.Error(w, "failed to perform OAuth2 exchange", http.StatusInternalServerError)
+		return
+	}
+
+	user, _, err := newUserClient(tokenResp.AccessToken).Users.Get(ctx, "")
+	if err != nil {
+		log.Printf("failed to fetch GitHub user: %v", err)
+		http.Error(w, "failed to fetch GitHub user", http.StatusInternalServerError)
+		return
+	}
+
+	duration := sessionDuration
+	if tokenResp.ExpiresIn > 0 && tokenResp.ExpiresIn < duration {
+		duration = tokenResp.ExpiresIn
+	}
+	session := &Session{
+		GitHubLogin: user.GetLogin(),
+		GitHubToken: tokenResp.AccessToken,
+		ExpiresAt:   time.Now().Add(duration),
+	}
+	token, err := srv.db.CreateSession(session)
+	if err != nil {
+		log.Printf("failed to create session: %v", err)
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirect := cookieValue.Get("redirect")
+	if !isLocalRedirect(redirect) {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (srv *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if !checkCSRFToken(r) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if err := srv.db.DeleteSession(cookie.Value); err != nil {
+			log.Printf("failed to delete session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// isLocalRedirect checks that a redirect target stays on this website.
+func isLocalRedirect(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "/\\")
+}
+
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+const (
+	badgeSecretKey = "badge_secret"
+	badgeMaxAge    = 5 * time.Minute
+	badgeLabel     = "builds.sr.ht"
+)
+
+// loadBadgeSecret returns the secret used to sign badge tokens, generating it
+// on first use.
+func loadBadgeSecret(db *DB) ([]byte, error) {
+	var secret []byte
+	err := db.GetMeta(badgeSecretKey, &secret)
+	if err == nil {
+		return secret, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := db.StoreMeta(badgeSecretKey, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// repoToken returns a token granting access to a resource of a private
+// repository, such as "badge" or "feed".
+func (srv *Server) repoToken(resource, repo string) string {
+	mac := hmac.New(sha256.New, srv.badgeSecret)
+	mac.Write([]byte(resource + ":" + strings.ToLower(repo)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkRepoToken checks a token returned by repoToken.
+func (srv *Server) checkRepoToken(resource, repo, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(srv.repoToken(resource, repo)))
+}
+
+// badgeToken returns the token granting access to the badge of a private
+// repository.
+func (srv *Server) badgeToken(repo string) string {
+	return srv.repoToken("badge", repo)
+}
+
+// badgeURL returns the URL of the badge of a repository. Private
+// repositories get a signed URL.
+func (srv *Server) badgeURL(repo string, private bool) string {
+	u := fmt.Sprintf("%v/badge/%v.svg", srv.publicURL, repo)
+	if private {
+		u += "?" + url.Values{"token": {srv.badgeToken(repo)}}.Encode()
+	}
+	return u
+}
+
+func jobStatusToBadge(status string) (message, color string) {
+	switch buildssrht.JobStatus(status) {
+	case buildssrht.JobStatusSuccess:
+		return "passing", "#4c1"
+	case buildssrht.JobStatusFailed:
+		return "failing", "#e05d44"
+	case buildssrht.JobStatusTimeout:
+		return "timed out", "#e05d44"
+	case buildssrht.JobStatusCancelled:
+		return "cancelled", "#9f9f9f"
+	default:
+		return "unknown", "#9f9f9f"
+	}
+}
+
+// renderBadge generates a flat badge. Widths are approximated, labels and
+// messages are always plain ASCII.
+func renderBadge(label, message, color string) []byte {
+	labelWidth := 10 + 7*len(label)
+	messageWidth := 10 + 7*len(message)
+	width := labelWidth + messageWidth
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%v" height="20" role="img" aria-label="%v: %v">`, width, label, message)
+	fmt.Fprintf(&buf, `<title>%v: %v</title>`, label, message)
+	fmt.Fprintf(&buf, `<rect width="%v" height="20" fill="#555"/>`, labelWidth)
+	fmt.Fprintf(&buf, `<rect x="%v" width="%v" height="20" fill="%v"/>`, labelWidth, messageWidth, color)
+	fmt.Fprintf(&buf, `<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">`)
+	fmt.Fprintf(&buf, `<text x="%v" y="14">%v</text>`, labelWidth/2, label)
+	fmt.Fprintf(&buf, `<text x="%v" y="14">%v</text>`, labelWidth+messageWidth/2, message)
+	fmt.Fprintf(&buf, `</g></svg>`)
+	return buf.Bytes()
+}
+
+// badgeJob returns the last finished job of a repository matching the badge
+// parameters. Private repositories require a valid token, otherwise no job is
+// returned.
+func (srv *Server) badgeJob(ctx context.Context, owner, name string, q url.Values) (job *Job, private bool, err error) {
+	repo, err := srv.getInstalledRepo(ctx, owner, name)
+	if err == ErrNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if repo.GetPrivate() {
+		if !srv.checkRepoToken("badge", repo.GetFullName(), q.Get("token")) {
+			return nil, true, nil
+		}
+	}
+
+	branch := q.Get("branch")
+	if branch == "" {
+		branch = repo.GetDefaultBranch()
+	}
+
+	jobs, err := srv.db.ListJobs(&JobQuery{
+		Repo:     repo.GetFullName(),
+		Branch:   branch,
+		Manifest: q.Get("manifest"),
+		Finished: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return nil, repo.GetPrivate(), fmt.Errorf("failed to list jobs for repository %v: %v", repo.GetFullName(), err)
+	} else if len(jobs) == 0 {
+		return nil, repo.GetPrivate(), nil
+	}
+	return jobs[0], repo.GetPrivate(), nil
+}
+
+func (srv *Server) handleBadge(w http.ResponseWriter, r *http.Request) {
+	// chi doesn't support suffixes for parameters which may contain dots
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "repo")
+	name, ok := strings.CutSuffix(name, ".svg")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Don't leak whether a repository exists: reply with an unknown badge
+	// on errors
+	job, private, err := srv.badgeJob(r.Context(), owner, name, r.URL.Query())
+	if err != nil {
+		log.Print(err)
+	}
+
+	var status string
+	var modTime time.Time
+	if job != nil {
+		status = job.Status
+		modTime = job.FinishedAt
+	}
+	cacheControl := "public"
+	if private {
+		cacheControl = "private"
+	}
+
+	message, color := jobStatusToBadge(status)
+	svg := renderBadge(badgeLabel, message, color)
+	sum := sha256.Sum256(svg)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", fmt.Sprintf("%v, max-age=%v", cacheControl, int(badgeMaxAge.Seconds())))
+	w.Header().Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(svg))
+}
@@ -558,3 +558,41 @@ func FetchUser(client *gqlclient.Client, ctx context.Context) (me *User, err err
 	err = client.Execute(ctx, op, &respData)
 	return respData.Me, err
 }
+
+func CancelJob(client *gqlclient.Client, ctx context.Context, id int32) (cancel *Job, err error) {
+	op := gqlclient.NewOperation("mutation cancelJob ($id: Int!) {\n\tcancel(jobId: $id) {\n\t\tid\n\t}\n}\n")
+	op.Var("id", id)
+	var respData struct {
+		Cancel *Job
+	}
+	err = client.Execute(ctx, op, &respData)
+	return respData.Cancel, err
+}
+
+func ProbeJobs(client *gqlclient.Client, ctx context.Context) (jobs *JobCursor, err error) {
+	op := gqlclient.NewOperation("query probeJobs {\n\tjobs {\n\t\tcursor\n\t}\n}\n")
+	var respData struct {
+		Jobs *JobCursor
+	}
+	err = client.Execute(ctx, op, &respData)
+	return respData.Jobs, err
+}
+
+func ProbeSecrets(client *gqlclient.Client, ctx context.Context) (secrets *SecretCursor, err error) {
+	op := gqlclient.NewOperation("query probeSecrets {\n\tsecrets {\n\t\tcursor\n\t}\n}\n")
+	var respData struct {
+		Secrets *SecretCursor
+	}
+	err = client.Execute(ctx, op, &respData)
+	return respData.Secrets, err
+}
+
+func FetchJobLogs(client *gqlclient.Client, ctx context.Context, id int32) (job *Job, err error) {
+	op := gqlclient.NewOperation("query fetchJobLogs ($id: Int!) {\n\tjob(id: $id) {\n\t\tstatus\n\t\tlog {\n\t\t\tfullURL\n\t\t}\n\t\ttasks {\n\t\t\tname\n\t\t\tstatus\n\t\t\tlog {\n\t\t\t\tfullURL\n\t\t\t}\n\t\t}\n\t}\n}\n")
+	op.Var("id", id)
+	var respData struct {
+		Job *Job
+	}
+	err = client.Execute(ctx, op, &respData)
+	return respData.Job, err
+}
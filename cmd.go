@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commandOptions holds the flags common to administrative commands.
+type commandOptions struct {
+	dbFilename  string
+	keyFilename string
+	json        bool
+
+	jobQuery JobQuery
+	redact   bool
+	force    bool
+}
+
+func newCommandFlagSet(name string, opts *commandOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.dbFilename, "db", "hottub.db", "database path")
+	fs.StringVar(&opts.keyFilename, "db-key", os.Getenv("HOTTUB_DB_KEY"), "database encryption key file")
+	fs.BoolVar(&opts.json, "json", false, "print JSON output")
+	return fs
+}
+
+// dbMode describes how an administrative command opens the DB.
+type dbMode int
+
+const (
+	// dbReadOnly opens the DB read-only, the schema must be up-to-date
+	dbReadOnly dbMode = iota
+	// dbInspect opens the DB read-only, whatever its schema version
+	dbInspect
+	// dbMigrate opens the DB read-write and upgrades its schema
+	dbMigrate
+)
+
+func (opts *commandOptions) openDB(mode dbMode) *DB {
+	var kr *keyring
+	if opts.keyFilename != "" {
+		var err error
+		kr, err = loadKeyring(opts.keyFilename)
+		if err != nil {
+			log.Fatalf("failed to load encryption keys: %v", err)
+		}
+	}
+
+	if mode == dbMigrate {
+		return createDB(opts.dbFilename, kr)
+	}
+	db := openDBReadOnly(opts.dbFilename, kr)
+	if mode == dbReadOnly {
+		if err := db.CheckSchemaVersion(); err != nil {
+			db.Close()
+			log.Fatalf("%v (start the server to upgrade the database)", err)
+		}
+	}
+	return db
+}
+
+type adminCommandFunc func(db *DB, opts *commandOptions, args []string) error
+
+// adminCommands lists the administrative commands, indexed by name. Each
+// command comes with a usage string for its positional arguments, and may
+// register additional flags.
+var adminCommands = map[string]struct {
+	usage string
+	run   adminCommandFunc
+	flags func(fs *flag.FlagSet, opts *commandOptions)
+	mode  dbMode
+}{
+	"installations list":   {"", installationsListCommand, nil, dbReadOnly},
+	"installations show":   {"<id>", installationsShowCommand, nil, dbReadOnly},
+	"installations delete": {"<id>", installationsDeleteCommand, nil, dbMigrate},
+	"jobs list":            {"", jobsListCommand, jobQueryFlags, dbReadOnly},
+	"token unlink":         {"<id> [sr.ht username]", tokenUnlinkCommand, nil, dbMigrate},
+	"db check":             {"", dbCheckCommand, nil, dbInspect},
+	"db export":            {"[file]", dbExportCommand, dbExportFlags, dbReadOnly},
+	"db import":            {"[file]", dbImportCommand, dbImportFlags, dbMigrate},
+}
+
+func jobQueryFlags(fs *flag.FlagSet, opts *commandOptions) {
+	fs.StringVar(&opts.jobQuery.Repo, "repo", "", "only list jobs for this repository (owner/name)")
+	fs.IntVar(&opts.jobQuery.PullRequest, "pr", 0, "only list jobs for this pull request number")
+	fs.StringVar(&opts.jobQuery.Commit, "commit", "", "only list jobs for this commit")
+	fs.IntVar(&opts.jobQuery.Limit, "limit", 50, "maximum number of jobs to list (0 for no limit)")
+}
+
+func dbExportFlags(fs *flag.FlagSet, opts *commandOptions) {
+	fs.BoolVar(&opts.redact, "redact", false, "strip sr.ht tokens from the export")
+}
+
+func dbImportFlags(fs *flag.FlagSet, opts *commandOptions) {
+	fs.BoolVar(&opts.force, "force", false, "overwrite existing records")
+}
+
+// adminCommand runs an administrative command operating on the DB.
+func adminCommand(group string, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: hottub %v <command> [options]", group)
+	}
+	name := group + " " + args[0]
+	cmd, ok := adminCommands[name]
+	if !ok {
+		log.Fatalf("unknown command %q", name)
+	}
+
+	var opts commandOptions
+	fs := newCommandFlagSet(name, &opts)
+	if cmd.flags != nil {
+		cmd.flags(fs, &opts)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: hottub %v [options] %v\n", name, cmd.usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	db := opts.openDB(cmd.mode)
+	err := cmd.run(db, &opts, fs.Args())
+	db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// rotateKeyCommand re-encrypts the sr.ht and session tokens stored in the DB
+// with the primary key of the key file.
+func rotateKeyCommand(args []string) {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	dbFilename := fs.String("db", "hottub.db", "database path")
+	keyFilename := fs.String("db-key", os.Getenv("HOTTUB_DB_KEY"), "database encryption key file")
+	fs.Parse(args)
+
+	if *keyFilename == "" {
+		log.Fatal("missing -db-key")
+	}
+	kr, err := loadKeyring(*keyFilename)
+	if err != nil {
+		log.Fatalf("failed to load encryption keys: %v", err)
+	}
+
+	db := createDB(*dbFilename, kr)
+	defer db.Close()
+
+	n, err := db.ReencryptInstallations()
+	if err != nil {
+		log.Fatalf("failed to re-encrypt installations: %v", err)
+	}
+	log.Printf("re-encrypted %v installations with key %q", n, kr.primary)
+
+	n, deleted, err := db.ReencryptSessions()
+	if err != nil {
+		log.Fatalf("failed to re-encrypt sessions: %v", err)
+	}
+	log.Printf("re-encrypted %v sessions, deleted %v stale sessions", n, deleted)
+}
+
+// installationView is the representation of an installation printed by
+// administrative commands. It never contains secrets.
+type installationView struct {
+	ID           int64             `json:"id"`
+	Owner        string            `json:"owner,omitempty"`
+	Org          string            `json:"org,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Suspended    bool              `json:"suspended"`
+	Disabled     bool              `json:"disabled"`
+	Permissions  map[string]string `json:"permissions,omitempty"`
+	SrhtAccounts []srhtAccountView `json:"srht_accounts"`
+	SrhtMapping  map[string]string `json:"srht_mapping,omitempty"`
+}
+
+type srhtAccountView struct {
+	Username       string     `json:"username"`
+	Default        bool       `json:"default"`
+	Grants         []string   `json:"grants,omitempty"`
+	TokenExpiresAt *time.Time `json:"token_expires_at,omitempty"`
+	NeedsReauth    bool       `json:"needs_reauth"`
+	Warnings       []string   `json:"warnings,omitempty"`
+}
+
+func newInstallationView(installation *Installation) *installationView {
+	view := &installationView{
+		ID:           installation.ID,
+		Owner:        installation.Owner,
+		Org:          installation.Org,
+		CreatedAt:    installation.CreatedAt,
+		Suspended:    installation.Suspended,
+		Disabled:     installation.Disabled,
+		Permissions:  installation.Permissions,
+		SrhtAccounts: []srhtAccountView{},
+		SrhtMapping:  installation.SrhtMapping,
+	}
+	for _, account := range listSrhtAccounts(installation) {
+		accountView := srhtAccountView{
+			Username:    account.SrhtUsername,
+			Default:     account.Default,
+			Grants:      account.SrhtGrants,
+			NeedsReauth: account.SrhtNeedsReauth,
+			Warnings:    account.Warnings,
+		}
+		if !account.SrhtTokenExpiresAt.IsZero() {
+			t := account.SrhtTokenExpiresAt
+			accountView.TokenExpiresAt = &t
+		}
+		view.SrhtAccounts = append(view.SrhtAccounts, accountView)
+	}
+	return view
+}
+
+// status returns a short summary of the state of the installation.
+func (view *installationView) status() string {
+	if view.Suspended {
+		return "suspended"
+	}
+	if view.Disabled {
+		return "disabled"
+	}
+	if len(view.SrhtAccounts) == 0 {
+		return "no sr.ht account"
+	}
+	for _, account := range view.SrhtAccounts {
+		if account.NeedsReauth {
+			return "needs re-authorization"
+		}
+	}
+	return "ok"
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+func parseInstallationID(args []string, maxArgs int) (int64, error) {
+	if len(args) == 0 || len(args) > maxArgs {
+		return 0, fmt.Errorf("invalid number of arguments")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid installation ID %q", args[0])
+	}
+	return id, nil
+}
+
+func getInstallationForCommand(db *DB, id int64) (*Installation, error) {
+	installation, err := db.GetInstallation(id)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("installation %v not found", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get installation %v: %v", id, err)
+	}
+	return installation, nil
+}
+
+func installationsListCommand(db *DB, opts *commandOptions, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	installations, err := db.ListInstallations()
+	if err != nil {
+		return fmt.Errorf("failed to list installations: %v", err)
+	}
+
+	views := make([]*installationView, len(installations))
+	for i, installation := range installations {
+		views[i] = newInstallationView(installation)
+	}
+
+	if opts.json {
+		return printJSON(views)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tOWNER\tORG\tSR.HT ACCOUNTS\tSTATUS")
+	for _, view := range views {
+		var usernames []string
+		for _, account := range view.SrhtAccounts {
+			usernames = append(usernames, account.Username)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", view.ID, view.Owner, view.Org, strings.Join(usernames, ", "), view.status())
+	}
+	return tw.Flush()
+}
+
+func installationsShowCommand(db *DB, opts *commandOptions, args []string) error {
+	id, err := parseInstallationID(args, 1)
+	if err != nil {
+		return err
+	}
+	installation, err := getInstallationForCommand(db, id)
+	if err != nil {
+		return err
+	}
+
+	view := newInstallationView(installation)
+	if opts.json {
+		return printJSON(view)
+	}
+
+	fmt.Printf("ID: %v\n", view.ID)
+	fmt.Printf("Owner: %v\n", view.Owner)
+	if view.Org != "" {
+		fmt.Printf("Organization: %v\n", view.Org)
+	}
+	fmt.Printf("Created: %v\n", view.CreatedAt.Format(time.RFC3339))
+	fmt.Printf("Status: %v\n", view.status())
+
+	for _, account := range view.SrhtAccounts {
+		username := account.Username
+		if username == "" {
+			username = "(unknown)"
+		}
+		if account.Default {
+			username += " (default)"
+		}
+		fmt.Printf("\nsr.ht account: %v\n", username)
+		fmt.Printf("  Grants: %v\n", strings.Join(account.Grants, " "))
+		if account.TokenExpiresAt != nil {
+			fmt.Printf("  Token expires: %v\n", account.TokenExpiresAt.Format(time.RFC3339))
+		}
+		for _, warning := range account.Warnings {
+			fmt.Printf("  Warning: %v\n", warning)
+		}
+	}
+
+	if len(view.SrhtMapping) > 0 {
+		fmt.Printf("\nsr.ht account mapping:\n")
+		for k, username := range view.SrhtMapping {
+			fmt.Printf("  %v: %v\n", k, username)
+		}
+	}
+
+	return nil
+}
+
+func installationsDeleteCommand(db *DB, opts *commandOptions, args []string) error {
+	id, err := parseInstallationID(args, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := getInstallationForCommand(db, id); err != nil {
+		return err
+	}
+
+	if err := db.DeleteInstallation(id); err != nil {
+		return fmt.Errorf("failed to delete installation %v: %v", id, err)
+	}
+	log.Printf("deleted installation %v", id)
+	return nil
+}
+
+func jobsListCommand(db *DB, opts *commandOptions, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	jobs, err := db.ListJobs(&opts.jobQuery)
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	if opts.json {
+		if jobs == nil {
+			jobs = []*Job{}
+		}
+		return printJSON(jobs)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tREPOSITORY\tCOMMIT\tREF\tMANIFEST\tSUBMITTER\tSTATUS\tSUBMITTED")
+	for _, job := range jobs {
+		commit := job.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		ref := job.Branch
+		if job.PullRequest != 0 {
+			ref = fmt.Sprintf("#%v", job.PullRequest)
+		} else if job.MergeGroup {
+			ref = "merge queue"
+		}
+		fmt.Fprintf(tw, "#%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", job.ID, job.Repo, commit, ref, job.Manifest, job.Submitter, job.Status, job.SubmittedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func tokenUnlinkCommand(db *DB, opts *commandOptions, args []string) error {
+	id, err := parseInstallationID(args, 2)
+	if err != nil {
+		return err
+	}
+
+	var username string
+	err = db.UpdateInstallation(id, func(installation *Installation) error {
+		username = installation.SrhtUsername
+		if len(args) > 1 {
+			username = args[1]
+		}
+		if !installation.UnlinkSrhtAccount(username) {
+			return fmt.Errorf("sr.ht account %q isn't linked to installation %v", username, id)
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		return fmt.Errorf("installation %v not found", id)
+	} else if err != nil {
+		return err
+	}
+	log.Printf("unlinked sr.ht account %q from installation %v", username, id)
+	return nil
+}
+
+func dbCheckCommand(db *DB, opts *commandOptions, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	report, err := db.Check()
+	if err != nil {
+		return fmt.Errorf("failed to check DB: %v", err)
+	}
+
+	if opts.json {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Schema version: %v\n", report.SchemaVersion)
+		fmt.Printf("Installations: %v\n", report.Installations)
+		fmt.Printf("Queued webhook deliveries: %v\n", report.QueuedDeliveries)
+		fmt.Printf("Dead webhook deliveries: %v\n", report.DeadDeliveries)
+		fmt.Printf("Builds: %v\n", report.Builds)
+		fmt.Printf("Jobs: %v\n", report.Jobs)
+		for _, problem := range report.Problems {
+			fmt.Printf("Problem: %v\n", problem)
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("found %v problems", len(report.Problems))
+	}
+	return nil
+}
+
+func dbExportCommand(db *DB, opts *commandOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	var f *os.File
+	if len(args) > 0 {
+		var err error
+		f, err = os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := os.Stdout
+	if f != nil {
+		w = f
+	}
+	n, err := db.Export(w, opts.redact)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return fmt.Errorf("failed to export DB: %v", err)
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("exported %v records", n)
+	return nil
+}
+
+func dbImportCommand(db *DB, opts *commandOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	r := os.Stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := db.Import(r, opts.force)
+	if err != nil {
+		return fmt.Errorf("failed to import DB: %v", err)
+	}
+	log.Printf("imported %v records", n)
+	return nil
+}
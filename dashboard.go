@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v56/github"
+)
+
+// dashboardJobs is the number of recent jobs displayed per installation.
+const dashboardJobs = 20
+
+type dashboardInstallation struct {
+	ID        int64
+	Account   string
+	HTMLURL   string
+	Pending   bool // not yet stored in the DB
+	Suspended bool
+	Disabled  bool
+	CanManage bool
+	ManageURL string
+
+	SrhtAccounts []srhtAccountStatus
+	SrhtMapping  map[string]string
+	Repos        []*github.Repository
+	Jobs         []*Job
+}
+
+func (srv *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	session := srv.requireSession(w, r)
+	if session == nil {
+		return
+	}
+
+	ctx := r.Context()
+	gh := session.GitHub()
+	ghInstallations, err := listUserInstallations(ctx, gh)
+	if err != nil {
+		log.Printf("failed to list installations for %v: %v", session.GitHubLogin, err)
+		http.Error(w, "failed to list installations", http.StatusInternalServerError)
+		return
+	}
+
+	var installations []*dashboardInstallation
+	for _, ghInstallation := range ghInstallations {
+		id := ghInstallation.GetID()
+		item := &dashboardInstallation{
+			ID:        id,
+			Account:   ghInstallation.GetAccount().GetLogin(),
+			HTMLURL:   ghInstallation.GetHTMLURL(),
+			ManageURL: fmt.Sprintf("/post-install?installation_id=%v", id),
+		}
+		installations = append(installations, item)
+
+		installation, err := srv.db.GetInstallation(id)
+		if err == ErrNotFound {
+			item.Pending = true
+			continue
+		} else if err != nil {
+			log.Printf("failed to get installation %v: %v", id, err)
+			http.Error(w, "failed to get installation", http.StatusInternalServerError)
+			return
+		}
+		item.Suspended = installation.Suspended
+		item.Disabled = installation.Disabled
+		item.SrhtAccounts = listSrhtAccounts(installation)
+		item.SrhtMapping = installation.SrhtMapping
+
+		item.CanManage, err = canManageInstallation(ctx, session.GitHub(), session.GitHubLogin, installation)
+		if err != nil {
+			log.Printf("failed to check permissions for installation %v: %v", id, err)
+			http.Error(w, "failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+
+		item.Repos, err = listUserInstallationRepos(ctx, gh, id)
+		if err != nil {
+			log.Printf("failed to list repositories of installation %v for %v: %v", id, session.GitHubLogin, err)
+			http.Error(w, "failed to list repositories", http.StatusInternalServerError)
+			return
+		}
+
+		// Only show jobs for repositories the user has access to
+		visible := make(map[string]bool)
+		for _, repo := range item.Repos {
+			visible[strings.ToLower(repo.GetFullName())] = true
+		}
+		jobs, err := srv.db.ListJobs(&JobQuery{InstallationID: id, Limit: 5 * dashboardJobs})
+		if err != nil {
+			log.Printf("failed to list jobs of installation %v: %v", id, err)
+			http.Error(w, "failed to list jobs", http.StatusInternalServerError)
+			return
+		}
+		for _, job := range jobs {
+			if len(item.Jobs) >= dashboardJobs {
+				break
+			}
+			if visible[strings.ToLower(job.Repo)] {
+				item.Jobs = append(item.Jobs, job)
+			}
+		}
+	}
+
+	data := struct {
+		Session       *Session
+		Installations []*dashboardInstallation
+		CSRFToken     string
+	}{
+		Session:       session,
+		Installations: installations,
+		CSRFToken:     csrfToken(r),
+	}
+	srv.renderTemplate(w, "dashboard.html", &data)
+}
@@ -1,48 +1,286 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"go.etcd.io/bbolt"
 )
 
-var installationsBucket = []byte("installations")
+const (
+	// dbPruneInterval is the interval at which expired records are removed.
+	dbPruneInterval = time.Hour
+	// dbOpenTimeout is how long to wait for another process to release the
+	// DB file.
+	dbOpenTimeout = 5 * time.Second
+)
+
+var (
+	installationsBucket = []byte("installations")
+	metaBucket          = []byte("meta")
+)
 
 var ErrNotFound = fmt.Errorf("resource not found in DB")
 
-type Installation struct {
-	ID                 int64     `json:"-"`
-	Owner              string    `json:"owner"`
-	Org                string    `json:"org,omitempty"`
-	CreatedAt          time.Time `json:"created_at"`
+// SrhtCredentials contains an OAuth2 token for a sr.ht account.
+type SrhtCredentials struct {
+	SrhtUsername       string    `json:"srht_username,omitempty"`
 	SrhtToken          string    `json:"srht_token,omitempty"`
 	SrhtRefreshToken   string    `json:"srht_refresh_token,omitempty"`
 	SrhtTokenExpiresAt time.Time `json:"srht_token_expires_at,omitempty"`
+	// Grants of the token, e.g. "builds.sr.ht/JOBS:RW", or nil if unknown
+	SrhtGrants []string `json:"srht_grants,omitempty"`
+
+	SrhtRefreshFailures int       `json:"srht_refresh_failures,omitempty"`
+	SrhtRefreshError    string    `json:"srht_refresh_error,omitempty"`
+	SrhtNextRefreshAt   time.Time `json:"srht_next_refresh_at,omitempty"`
+	// SrhtNeedsReauth is set when the token can't be used anymore, and the
+	// account needs to be linked again
+	SrhtNeedsReauth bool `json:"srht_needs_reauth,omitempty"`
+}
+
+// HasGrant checks whether the token has a grant such as
+// "builds.sr.ht/JOBS:RO". Read-write grants imply read-only grants. Tokens
+// with unknown grants are assumed to have all grants.
+func (creds *SrhtCredentials) HasGrant(grant string) bool {
+	if creds.SrhtGrants == nil {
+		return true
+	}
+	for _, g := range creds.SrhtGrants {
+		if g == grant || (strings.HasSuffix(grant, ":RO") && g == strings.TrimSuffix(grant, ":RO")+":RW") {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingGrants returns the grants from a space-separated list which the
+// token doesn't have.
+func (creds *SrhtCredentials) MissingGrants(grants string) []string {
+	var missing []string
+	for _, grant := range strings.Fields(grants) {
+		if !creds.HasGrant(grant) {
+			missing = append(missing, grant)
+		}
+	}
+	return missing
+}
+
+type Installation struct {
+	ID        int64     `json:"-"`
+	Owner     string    `json:"owner"`
+	Org       string    `json:"org,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Default sr.ht account, used for repositories without a mapping
+	SrhtCredentials
+	// Additional sr.ht accounts, by username
+	SrhtAccounts map[string]*SrhtCredentials `json:"srht_accounts,omitempty"`
+	// SrhtMapping maps repository names ("hottub") and team slugs prefixed
+	// with "@" ("@maintainers") to sr.ht usernames in SrhtAccounts
+	SrhtMapping map[string]string `json:"srht_mapping,omitempty"`
+
+	// Suspended is set when the installation has been suspended on GitHub
+	Suspended bool `json:"suspended,omitempty"`
+	// Disabled is set when the installation has been disabled by an
+	// administrator of this instance
+	Disabled bool `json:"disabled,omitempty"`
+	// Permissions contains the permissions granted to the GitHub app, e.g.
+	// "checks": "write"
+	Permissions map[string]string `json:"permissions,omitempty"`
+}
+
+// clone returns a copy of the installation which can be modified without
+// affecting the original.
+func (installation *Installation) clone() *Installation {
+	c := *installation
+	if installation.SrhtAccounts != nil {
+		c.SrhtAccounts = make(map[string]*SrhtCredentials, len(installation.SrhtAccounts))
+		for username, creds := range installation.SrhtAccounts {
+			credsCopy := *creds
+			c.SrhtAccounts[username] = &credsCopy
+		}
+	}
+	return &c
+}
+
+func (installation *Installation) forEachSrhtCredentials(f func(creds *SrhtCredentials) error) error {
+	if err := f(&installation.SrhtCredentials); err != nil {
+		return err
+	}
+	for _, creds := range installation.SrhtAccounts {
+		if err := f(creds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LinkSrhtAccount adds a sr.ht account to the installation. The account
+// becomes the default one if the installation doesn't have one yet. The
+// repositories and teams listed in mapping are assigned to the account.
+func (installation *Installation) LinkSrhtAccount(creds *SrhtCredentials, mapping []string) {
+	username := creds.SrhtUsername
+	replaceDefault := installation.SrhtToken == "" || installation.SrhtUsername == username
+	// A default account which needs to be linked again can be replaced
+	replaceDefault = replaceDefault || (installation.SrhtNeedsReauth && len(mapping) == 0)
+	if replaceDefault {
+		installation.SrhtCredentials = *creds
+	} else {
+		if installation.SrhtAccounts == nil {
+			installation.SrhtAccounts = make(map[string]*SrhtCredentials)
+		}
+		installation.SrhtAccounts[username] = creds
+	}
+
+	for _, k := range mapping {
+		if installation.SrhtMapping == nil {
+			installation.SrhtMapping = make(map[string]string)
+		}
+		installation.SrhtMapping[k] = username
+	}
+}
+
+// RelinkSrhtAccount replaces the credentials of a linked sr.ht account, e.g.
+// to renew an expired token or to upgrade its grants. The new credentials may
+// belong to another sr.ht user, in which case the repositories and teams
+// mapped to the old account are mapped to the new one. It returns false if no
+// such account is linked.
+func (installation *Installation) RelinkSrhtAccount(username string, creds *SrhtCredentials) bool {
+	if username == installation.SrhtUsername {
+		installation.SrhtCredentials = *creds
+		delete(installation.SrhtAccounts, creds.SrhtUsername)
+	} else if _, ok := installation.SrhtAccounts[username]; ok {
+		delete(installation.SrhtAccounts, username)
+		installation.LinkSrhtAccount(creds, nil)
+	} else {
+		return false
+	}
+
+	for k, v := range installation.SrhtMapping {
+		if v == username {
+			installation.SrhtMapping[k] = creds.SrhtUsername
+		}
+	}
+	return true
+}
+
+// UnlinkSrhtAccount removes a linked sr.ht account, along with the
+// repositories and teams mapped to it. It returns false if no such account is
+// linked.
+func (installation *Installation) UnlinkSrhtAccount(username string) bool {
+	if username == installation.SrhtUsername && installation.SrhtToken != "" {
+		installation.SrhtCredentials = SrhtCredentials{}
+	} else if _, ok := installation.SrhtAccounts[username]; ok {
+		delete(installation.SrhtAccounts, username)
+	} else {
+		return false
+	}
+
+	for k, v := range installation.SrhtMapping {
+		if v == username {
+			delete(installation.SrhtMapping, k)
+		}
+	}
+	return true
+}
+
+// srhtCredentialsByUsername returns the linked sr.ht account with the
+// specified username, or nil if there is none.
+func (installation *Installation) srhtCredentialsByUsername(username string) *SrhtCredentials {
+	if username == installation.SrhtUsername {
+		return &installation.SrhtCredentials
+	}
+	return installation.SrhtAccounts[username]
+}
+
+// SrhtCredentialsFor returns the sr.ht account to use for a repository.
+// Repository mappings take precedence over team mappings.
+func (installation *Installation) SrhtCredentialsFor(repo string, teams []string) *SrhtCredentials {
+	keys := append([]string{repo}, teams...)
+	for i, k := range keys {
+		if i > 0 {
+			k = "@" + k
+		}
+		username, ok := installation.SrhtMapping[k]
+		if !ok {
+			continue
+		}
+		if username == installation.SrhtUsername {
+			return &installation.SrhtCredentials
+		}
+		if creds, ok := installation.SrhtAccounts[username]; ok {
+			return creds
+		}
+	}
+	return &installation.SrhtCredentials
+}
+
+// hasTeamMapping returns true if some teams are mapped to a sr.ht account.
+func (installation *Installation) hasTeamMapping() bool {
+	for k := range installation.SrhtMapping {
+		if strings.HasPrefix(k, "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// UseChecks returns true if the installation can report job statuses via the
+// GitHub Checks API.
+func (installation *Installation) UseChecks() bool {
+	return installation.Permissions["checks"] == "write"
 }
 
 type DB struct {
 	*bbolt.DB
+	keyring *keyring // may be nil
 }
 
-func createDB(filename string) *DB {
-	db, err := bbolt.Open(filename, 0600, nil)
+// createDB opens the DB, creating it if necessary, and upgrades its schema.
+func createDB(filename string, kr *keyring) *DB {
+	db, err := bbolt.Open(filename, 0600, &bbolt.Options{Timeout: dbOpenTimeout})
 	if err != nil {
 		log.Fatalf("failed to open DB: %v", err)
 	}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(installationsBucket)
-		return err
-	})
+	from, to, err := migrateDB(db)
 	if err != nil {
-		log.Fatalf("failed to init DB: %v", err)
+		log.Fatalf("failed to migrate DB: %v", err)
+	} else if from != to {
+		log.Printf("migrated DB schema from version %v to %v", from, to)
 	}
 
-	return &DB{DB: db}
+	return &DB{DB: db, keyring: kr}
+}
+
+// openDBReadOnly opens an existing DB in read-only mode. The schema isn't
+// upgraded, so some buckets may be missing.
+func openDBReadOnly(filename string, kr *keyring) *DB {
+	db, err := bbolt.Open(filename, 0600, &bbolt.Options{Timeout: dbOpenTimeout, ReadOnly: true})
+	if err != nil {
+		log.Fatalf("failed to open DB: %v", err)
+	}
+	return &DB{DB: db, keyring: kr}
+}
+
+// CheckSchemaVersion returns an error if the DB schema isn't the one expected
+// by this version of hottub.
+func (db *DB) CheckSchemaVersion() error {
+	return db.View(func(tx *bbolt.Tx) error {
+		version, err := getSchemaVersion(tx)
+		if err != nil {
+			return err
+		} else if version != len(migrations) {
+			return fmt.Errorf("database schema version is %v, expected %v", version, len(migrations))
+		}
+		return nil
+	})
 }
 
 func (db *DB) GetInstallation(id int64) (*Installation, error) {
@@ -53,14 +291,30 @@ func (db *DB) GetInstallation(id int64) (*Installation, error) {
 			return ErrNotFound
 		}
 
-		installation = &Installation{ID: id}
-		return json.Unmarshal(b, installation)
+		var err error
+		installation, err = db.unmarshalInstallation(id, b)
+		return err
 	})
 	return installation, err
 }
 
+func (db *DB) ListInstallations() ([]*Installation, error) {
+	var l []*Installation
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(installationsBucket).ForEach(func(k, v []byte) error {
+			installation, err := db.unmarshalInstallation(int64(binary.BigEndian.Uint64(k)), v)
+			if err != nil {
+				return err
+			}
+			l = append(l, installation)
+			return nil
+		})
+	})
+	return l, err
+}
+
 func (db *DB) StoreInstallation(installation *Installation) error {
-	b, err := json.Marshal(installation)
+	b, err := db.marshalInstallation(installation)
 	if err != nil {
 		return err
 	}
@@ -69,12 +323,265 @@ func (db *DB) StoreInstallation(installation *Installation) error {
 	})
 }
 
+// UpdateInstallation reads an installation, calls fn to modify it and stores
+// the result in a single transaction, so that concurrent updates aren't lost.
+// The installation isn't stored if fn returns an error.
+func (db *DB) UpdateInstallation(id int64, fn func(installation *Installation) error) error {
+	return db.DB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(installationsBucket)
+		v := bucket.Get(marshalID(id))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		installation, err := db.unmarshalInstallation(id, v)
+		if err != nil {
+			return err
+		}
+		if err := fn(installation); err != nil {
+			return err
+		}
+
+		b, err := db.marshalInstallation(installation)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(marshalID(id), b)
+	})
+}
+
+// ReencryptInstallations re-encrypts the sr.ht tokens of all installations
+// with the primary key. It returns the number of installations updated.
+func (db *DB) ReencryptInstallations() (int, error) {
+	if db.keyring == nil {
+		return 0, fmt.Errorf("no encryption key configured")
+	}
+
+	var n int
+	err := db.DB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(installationsBucket)
+
+		updated := make(map[int64][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			id := int64(binary.BigEndian.Uint64(k))
+			installation, err := db.unmarshalInstallation(id, v)
+			if err != nil {
+				return err
+			}
+			b, err := db.marshalInstallation(installation)
+			if err != nil {
+				return err
+			}
+			updated[id] = b
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for id, b := range updated {
+			if err := bucket.Put(marshalID(id), b); err != nil {
+				return err
+			}
+		}
+		n = len(updated)
+		return nil
+	})
+	return n, err
+}
+
+// DBCheckReport is the result of a DB consistency check.
+type DBCheckReport struct {
+	SchemaVersion    int      `json:"schema_version"`
+	Installations    int      `json:"installations"`
+	QueuedDeliveries int      `json:"queued_deliveries"`
+	DeadDeliveries   int      `json:"dead_deliveries"`
+	Builds           int      `json:"builds"`
+	Jobs             int      `json:"jobs"`
+	Problems         []string `json:"problems"`
+}
+
+// Check verifies the consistency of the DB file and checks that all records
+// can be decoded.
+func (db *DB) Check() (*DBCheckReport, error) {
+	report := &DBCheckReport{Problems: []string{}}
+	err := db.View(func(tx *bbolt.Tx) error {
+		for err := range tx.Check() {
+			report.Problems = append(report.Problems, err.Error())
+		}
+
+		var err error
+		report.SchemaVersion, err = getSchemaVersion(tx)
+		if err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		} else if report.SchemaVersion != len(migrations) {
+			report.Problems = append(report.Problems, fmt.Sprintf("schema version is %v, expected %v", report.SchemaVersion, len(migrations)))
+		}
+
+		// The schema may be outdated: report missing buckets instead of
+		// failing
+		forEach := func(name []byte, fn func(k, v []byte)) error {
+			b := tx.Bucket(name)
+			if b == nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("missing bucket %q", name))
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				fn(k, v)
+				return nil
+			})
+		}
+
+		err = forEach(installationsBucket, func(k, v []byte) {
+			report.Installations++
+			if _, err := db.unmarshalInstallation(int64(binary.BigEndian.Uint64(k)), v); err != nil {
+				report.Problems = append(report.Problems, err.Error())
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		deliveryBuckets := map[string]*int{
+			string(webhookQueueBucket): &report.QueuedDeliveries,
+			string(webhookDeadBucket):  &report.DeadDeliveries,
+		}
+		for name, n := range deliveryBuckets {
+			err := forEach([]byte(name), func(k, v []byte) {
+				*n++
+				if _, err := unmarshalDelivery(k, v); err != nil {
+					report.Problems = append(report.Problems, err.Error())
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = forEach(buildsBucket, func(k, v []byte) {
+			report.Builds++
+			var build Build
+			if err := json.Unmarshal(v, &build); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("failed to decode build %q: %v", k, err))
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		return forEach(jobsBucket, func(k, v []byte) {
+			report.Jobs++
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("failed to decode job #%v: %v", binary.BigEndian.Uint32(k), err))
+			}
+		})
+	})
+	return report, err
+}
+
 func (db *DB) DeleteInstallation(id int64) error {
 	return db.DB.Batch(func(tx *bbolt.Tx) error {
 		return tx.Bucket(installationsBucket).Delete(marshalID(id))
 	})
 }
 
+// GetMeta reads a JSON-encoded value from the meta bucket.
+func (db *DB) GetMeta(key string, v interface{}) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(metaBucket).Get([]byte(key))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, v)
+	})
+}
+
+func (db *DB) StoreMeta(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(key), b)
+	})
+}
+
+// marshalInstallation encodes an installation, encrypting its sr.ht tokens if
+// a key is configured.
+func (db *DB) marshalInstallation(installation *Installation) ([]byte, error) {
+	if db.keyring == nil {
+		return json.Marshal(installation)
+	}
+
+	encrypted := installation.clone()
+	additionalData := marshalID(installation.ID)
+	err := encrypted.forEachSrhtCredentials(func(creds *SrhtCredentials) error {
+		for _, field := range []*string{&creds.SrhtToken, &creds.SrhtRefreshToken} {
+			if *field == "" {
+				continue
+			}
+			v, err := db.keyring.Encrypt(*field, additionalData)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt sr.ht token: %v", err)
+			}
+			*field = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encrypted)
+}
+
+func (db *DB) unmarshalInstallation(id int64, b []byte) (*Installation, error) {
+	installation := &Installation{ID: id}
+	if err := json.Unmarshal(b, installation); err != nil {
+		return nil, err
+	}
+
+	additionalData := marshalID(id)
+	err := installation.forEachSrhtCredentials(func(creds *SrhtCredentials) error {
+		for _, field := range []*string{&creds.SrhtToken, &creds.SrhtRefreshToken} {
+			if !strings.HasPrefix(*field, encryptedPrefix) {
+				continue
+			}
+			if db.keyring == nil {
+				return fmt.Errorf("installation %v has encrypted sr.ht tokens, but no encryption key is configured", id)
+			}
+			v, err := db.keyring.Decrypt(*field, additionalData)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt sr.ht token for installation %v: %v", id, err)
+			}
+			*field = v
+		}
+		return nil
+	})
+	return installation, err
+}
+
+// pruneDBPeriodically removes expired records from the DB.
+func pruneDBPeriodically(ctx context.Context, db *DB, buildWindow time.Duration) {
+	ticker := time.NewTicker(dbPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := db.PruneDedup(buildWindow); err != nil {
+			log.Printf("failed to prune deduplication records: %v", err)
+		}
+		if err := db.PruneSessions(); err != nil {
+			log.Printf("failed to prune sessions: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func marshalID(id int64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, uint64(id))
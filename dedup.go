@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// deliveryRetention is how long webhook delivery IDs are remembered.
+const deliveryRetention = 7 * 24 * time.Hour
+
+var (
+	deliveriesBucket = []byte("deliveries")
+	buildsBucket     = []byte("builds")
+)
+
+var ErrDuplicate = fmt.Errorf("duplicate webhook delivery")
+
+// Build is a sr.ht job submitted for a manifest at a given commit.
+type Build struct {
+	JobID       int32     `json:"job_id"`
+	DetailsURL  string    `json:"details_url"`
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
+// buildKey computes the deduplication key for a build.
+func buildKey(repo, sha, manifestPath string, manifest []byte) []byte {
+	manifestHash := sha256.Sum256(manifest)
+	return []byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v", repo, sha, manifestPath, hex.EncodeToString(manifestHash[:])))
+}
+
+// GetRecentBuild looks up a build submitted less than window ago.
+func (db *DB) GetRecentBuild(key []byte, window time.Duration) (*Build, error) {
+	var build *Build
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(buildsBucket).Get(key)
+		if b == nil {
+			return ErrNotFound
+		}
+
+		build = new(Build)
+		if err := json.Unmarshal(b, build); err != nil {
+			return err
+		}
+		if time.Since(build.SubmittedAt) > window {
+			build = nil
+			return ErrNotFound
+		}
+		return nil
+	})
+	return build, err
+}
+
+func (db *DB) StoreBuild(key []byte, build *Build) error {
+	b, err := json.Marshal(build)
+	if err != nil {
+		return err
+	}
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(buildsBucket).Put(key, b)
+	})
+}
+
+// markDeliverySeen records a webhook delivery ID, and returns ErrDuplicate if
+// it has already been seen.
+func markDeliverySeen(tx *bbolt.Tx, guid string, t time.Time) error {
+	b := tx.Bucket(deliveriesBucket)
+	if b.Get([]byte(guid)) != nil {
+		return ErrDuplicate
+	}
+	v, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(guid), v)
+}
+
+func (db *DB) HasSeenDelivery(guid string) (bool, error) {
+	var seen bool
+	err := db.View(func(tx *bbolt.Tx) error {
+		seen = tx.Bucket(deliveriesBucket).Get([]byte(guid)) != nil
+		return nil
+	})
+	return seen, err
+}
+
+// PruneDedup removes delivery IDs and builds which are too old to be useful
+// for deduplication.
+func (db *DB) PruneDedup(buildWindow time.Duration) error {
+	now := time.Now()
+	return db.DB.Update(func(tx *bbolt.Tx) error {
+		err := pruneBucket(tx.Bucket(deliveriesBucket), func(v []byte) bool {
+			var t time.Time
+			return t.UnmarshalText(v) != nil || now.Sub(t) > deliveryRetention
+		})
+		if err != nil {
+			return err
+		}
+
+		return pruneBucket(tx.Bucket(buildsBucket), func(v []byte) bool {
+			var build Build
+			return json.Unmarshal(v, &build) != nil || now.Sub(build.SubmittedAt) > buildWindow
+		})
+	})
+}
+
+func pruneBucket(b *bbolt.Bucket, expired func(v []byte) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if expired(v) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBuildKey(t *testing.T) {
+	key := buildKey("owner/repo", "abc", ".build.yml", []byte("image: alpine/edge"))
+	tests := []struct {
+		name            string
+		repo, sha, path string
+		manifest        string
+		wantSame        bool
+	}{
+		{"same", "owner/repo", "abc", ".build.yml", "image: alpine/edge", true},
+		{"repo", "owner/other", "abc", ".build.yml", "image: alpine/edge", false},
+		{"commit", "owner/repo", "def", ".build.yml", "image: alpine/edge", false},
+		{"path", "owner/repo", "abc", ".builds/alpine.yml", "image: alpine/edge", false},
+		{"manifest", "owner/repo", "abc", ".build.yml", "image: debian/sid", false},
+		// Fields are separated, so they can't be shifted into each other
+		{"separator", "owner/repoa", "bc", ".build.yml", "image: alpine/edge", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			other := buildKey(tc.repo, tc.sha, tc.path, []byte(tc.manifest))
+			if same := bytes.Equal(key, other); same != tc.wantSame {
+				t.Errorf("keys equal = %v, want %v", same, tc.wantSame)
+			}
+		})
+	}
+}
+
+func TestGetRecentBuild(t *testing.T) {
+	db := openMigratedTestDB(t, nil)
+
+	key := buildKey("owner/repo", "abc", ".build.yml", nil)
+	build := &Build{
+		JobID:       42,
+		DetailsURL:  "https://builds.sr.ht/~user/job/42",
+		SubmittedAt: time.Now().Add(-10 * time.Minute),
+	}
+	if err := db.StoreBuild(key, build); err != nil {
+		t.Fatalf("StoreBuild() = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		window  time.Duration
+		wantErr error
+	}{
+		{"within window", key, time.Hour, nil},
+		{"outside window", key, 5 * time.Minute, ErrNotFound},
+		{"unknown key", buildKey("owner/repo", "def", ".build.yml", nil), time.Hour, ErrNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := db.GetRecentBuild(tc.key, tc.window)
+			if err != tc.wantErr {
+				t.Fatalf("GetRecentBuild() = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr != nil {
+				if got != nil {
+					t.Errorf("GetRecentBuild() returned a build along with an error")
+				}
+				return
+			}
+			if got.JobID != build.JobID || got.DetailsURL != build.DetailsURL {
+				t.Errorf("GetRecentBuild() = %+v, want %+v", got, build)
+			}
+		})
+	}
+}
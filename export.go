@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	exportFormat        = "hottub-export"
+	exportFormatVersion = 1
+)
+
+// exportBuckets lists the buckets included in exports. Sessions and seen
+// webhook delivery IDs are short-lived, and the job index is rebuilt on
+// import.
+var exportBuckets = [][]byte{
+	installationsBucket,
+	metaBucket,
+	webhookQueueBucket,
+	webhookDeadBucket,
+	buildsBucket,
+	jobsBucket,
+	repoSettingsBucket,
+}
+
+// exportHeader is the first value of an export stream.
+type exportHeader struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	ExportedAt    time.Time `json:"exported_at"`
+	Redacted      bool      `json:"redacted,omitempty"`
+}
+
+// exportRecord is a key-value pair of a bucket. Values are stored as-is, so
+// encrypted tokens stay encrypted.
+type exportRecord struct {
+	Bucket string          `json:"bucket"`
+	Key    []byte          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Export writes the contents of the DB as a stream of JSON values: a header
+// followed by one record per line. If redact is set, sr.ht tokens and
+// secrets are stripped. It returns the number of records written.
+func (db *DB) Export(w io.Writer, redact bool) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var n int
+	err := db.View(func(tx *bbolt.Tx) error {
+		schemaVersion, err := getSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		header := exportHeader{
+			Format:        exportFormat,
+			Version:       exportFormatVersion,
+			SchemaVersion: schemaVersion,
+			ExportedAt:    time.Now(),
+			Redacted:      redact,
+		}
+		if err := enc.Encode(&header); err != nil {
+			return err
+		}
+
+		for _, bucket := range exportBuckets {
+			err := tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+				if isInternalMetaKey(bucket, k) || (redact && isSecretMetaKey(bucket, k)) {
+					return nil
+				}
+				if redact {
+					var err error
+					if v, err = redactRecord(bucket, v); err != nil {
+						return fmt.Errorf("failed to redact %v record %x: %v", string(bucket), k, err)
+					}
+				}
+
+				n++
+				return enc.Encode(&exportRecord{
+					Bucket: string(bucket),
+					Key:    k,
+					Value:  v,
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// isInternalMetaKey checks whether a record is managed by the DB itself and
+// must not be exported nor imported.
+func isInternalMetaKey(bucket, k []byte) bool {
+	return string(bucket) == string(metaBucket) && string(k) == schemaVersionKey
+}
+
+// isSecretMetaKey checks whether a record holds a secret generated by hottub.
+func isSecretMetaKey(bucket, k []byte) bool {
+	return string(bucket) == string(metaBucket) && string(k) == badgeSecretKey
+}
+
+// redactRecord strips secrets from a record.
+func redactRecord(bucket, v []byte) ([]byte, error) {
+	if string(bucket) != string(installationsBucket) {
+		return v, nil
+	}
+
+	var installation Installation
+	if err := json.Unmarshal(v, &installation); err != nil {
+		return nil, err
+	}
+	installation.forEachSrhtCredentials(func(creds *SrhtCredentials) error {
+		if creds.SrhtToken != "" {
+			creds.SrhtNeedsReauth = true
+		}
+		creds.SrhtToken = ""
+		creds.SrhtRefreshToken = ""
+		return nil
+	})
+	return json.Marshal(&installation)
+}
+
+// Import reads a stream written by Export and stores its records. Existing
+// records are only overwritten if force is set. Nothing is written if the
+// stream is invalid. It returns the number of records imported.
+func (db *DB) Import(r io.Reader, force bool) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("failed to read export header: %v", err)
+	}
+	if header.Format != exportFormat {
+		return 0, fmt.Errorf("not a hottub export")
+	} else if header.Version != exportFormatVersion {
+		return 0, fmt.Errorf("unsupported export format version %v", header.Version)
+	} else if header.SchemaVersion != len(migrations) {
+		return 0, fmt.Errorf("export has schema version %v, but this version of hottub requires %v", header.SchemaVersion, len(migrations))
+	}
+
+	var records []exportRecord
+	for {
+		var record exportRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read record %v: %v", len(records)+1, err)
+		}
+		if err := db.validateRecord(&record); err != nil {
+			return 0, fmt.Errorf("invalid %v record %x: %v", record.Bucket, record.Key, err)
+		}
+		records = append(records, record)
+	}
+
+	err := db.DB.Update(func(tx *bbolt.Tx) error {
+		if !force {
+			for _, record := range records {
+				if tx.Bucket([]byte(record.Bucket)).Get(record.Key) != nil {
+					return fmt.Errorf("%v record %x already exists (use -force to overwrite)", record.Bucket, record.Key)
+				}
+			}
+		}
+
+		for _, record := range records {
+			b := tx.Bucket([]byte(record.Bucket))
+			if err := b.Put(record.Key, record.Value); err != nil {
+				return err
+			}
+
+			switch record.Bucket {
+			case string(webhookQueueBucket), string(webhookDeadBucket):
+				// Make sure new deliveries don't overwrite imported ones
+				if seq := binary.BigEndian.Uint64(record.Key); seq > b.Sequence() {
+					if err := b.SetSequence(seq); err != nil {
+						return err
+					}
+				}
+			case string(jobsBucket):
+				var job Job
+				if err := json.Unmarshal(record.Value, &job); err != nil {
+					return err
+				}
+				if err := indexJob(tx, &job); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+func (db *DB) validateRecord(record *exportRecord) error {
+	if !json.Valid(record.Value) {
+		return fmt.Errorf("value is not valid JSON")
+	}
+
+	exported := false
+	for _, bucket := range exportBuckets {
+		if record.Bucket == string(bucket) {
+			exported = true
+			break
+		}
+	}
+	if !exported {
+		return fmt.Errorf("unknown bucket")
+	}
+	if isInternalMetaKey([]byte(record.Bucket), record.Key) {
+		return fmt.Errorf("reserved key")
+	}
+
+	switch record.Bucket {
+	case string(installationsBucket):
+		if len(record.Key) != 8 {
+			return fmt.Errorf("invalid key")
+		}
+		_, err := db.unmarshalInstallation(int64(binary.BigEndian.Uint64(record.Key)), record.Value)
+		return err
+	case string(webhookQueueBucket), string(webhookDeadBucket):
+		if len(record.Key) != 8 {
+			return fmt.Errorf("invalid key")
+		}
+		_, err := unmarshalDelivery(record.Key, record.Value)
+		return err
+	case string(buildsBucket):
+		var build Build
+		return json.Unmarshal(record.Value, &build)
+	case string(jobsBucket):
+		if len(record.Key) != 4 {
+			return fmt.Errorf("invalid key")
+		}
+		var job Job
+		if err := json.Unmarshal(record.Value, &job); err != nil {
+			return err
+		}
+		if job.ID != int32(binary.BigEndian.Uint32(record.Key)) {
+			return fmt.Errorf("job ID doesn't match key")
+		}
+	case string(repoSettingsBucket):
+		if len(record.Key) != 8 {
+			return fmt.Errorf("invalid key")
+		}
+		var settings RepoSettings
+		return json.Unmarshal(record.Value, &settings)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestExport(t *testing.T, header *exportHeader, records ...exportRecord) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(header); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := enc.Encode(&record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func validExportHeader() *exportHeader {
+	return &exportHeader{
+		Format:        exportFormat,
+		Version:       exportFormatVersion,
+		SchemaVersion: len(migrations),
+		ExportedAt:    time.Now(),
+	}
+}
+
+func TestImport_invalid(t *testing.T) {
+	jobRecord := exportRecord{
+		Bucket: string(jobsBucket),
+		Key:    marshalJobID(1),
+		Value:  json.RawMessage(`{"id":2,"repo":"owner/repo"}`),
+	}
+
+	tests := []struct {
+		name    string
+		header  func(header *exportHeader)
+		record  exportRecord
+		wantErr string
+	}{
+		{
+			name:    "format",
+			header:  func(header *exportHeader) { header.Format = "something-else" },
+			wantErr: "not a hottub export",
+		},
+		{
+			name:    "format version",
+			header:  func(header *exportHeader) { header.Version = exportFormatVersion + 1 },
+			wantErr: "unsupported export format version",
+		},
+		{
+			name:    "schema version",
+			header:  func(header *exportHeader) { header.SchemaVersion = len(migrations) - 1 },
+			wantErr: "schema version",
+		},
+		{
+			name:    "unexported bucket",
+			record:  exportRecord{Bucket: string(sessionsBucket), Key: []byte("x"), Value: json.RawMessage(`{}`)},
+			wantErr: "unknown bucket",
+		},
+		{
+			name:    "reserved key",
+			record:  exportRecord{Bucket: string(metaBucket), Key: []byte(schemaVersionKey), Value: json.RawMessage(`1`)},
+			wantErr: "reserved key",
+		},
+		{
+			name:    "installation key",
+			record:  exportRecord{Bucket: string(installationsBucket), Key: []byte("1"), Value: json.RawMessage(`{}`)},
+			wantErr: "invalid key",
+		},
+		{
+			name:    "installation value",
+			record:  exportRecord{Bucket: string(installationsBucket), Key: marshalID(1), Value: json.RawMessage(`[]`)},
+			wantErr: "invalid installations record",
+		},
+		{
+			name:    "delivery key",
+			record:  exportRecord{Bucket: string(webhookQueueBucket), Key: []byte("1"), Value: json.RawMessage(`{}`)},
+			wantErr: "invalid key",
+		},
+		{
+			name:    "job ID",
+			record:  jobRecord,
+			wantErr: "job ID doesn't match key",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := openMigratedTestDB(t, nil)
+
+			header := validExportHeader()
+			if tc.header != nil {
+				tc.header(header)
+			}
+			var records []exportRecord
+			if tc.record.Bucket != "" {
+				records = append(records, tc.record)
+			}
+
+			_, err := db.Import(writeTestExport(t, header, records...), false)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Import() = %v, want error containing %q", err, tc.wantErr)
+			}
+			if jobs, err := db.ListJobs(&JobQuery{}); err != nil {
+				t.Fatalf("ListJobs() = %v", err)
+			} else if len(jobs) != 0 {
+				t.Errorf("ListJobs() = %v jobs after failed import, want 0", len(jobs))
+			}
+		})
+	}
+}
+
+func TestImport_existing(t *testing.T) {
+	db := openMigratedTestDB(t, nil)
+	if err := db.StoreInstallation(&Installation{ID: 1, Owner: "alice"}); err != nil {
+		t.Fatalf("StoreInstallation() = %v", err)
+	}
+
+	record := exportRecord{
+		Bucket: string(installationsBucket),
+		Key:    marshalID(1),
+		Value:  json.RawMessage(`{"owner":"bob"}`),
+	}
+	if _, err := db.Import(writeTestExport(t, validExportHeader(), record), false); err == nil {
+		t.Fatal("Import() overwrote an existing record without force")
+	}
+	if installation, err := db.GetInstallation(1); err != nil {
+		t.Fatalf("GetInstallation() = %v", err)
+	} else if installation.Owner != "alice" {
+		t.Errorf("installation owner = %q, want %q", installation.Owner, "alice")
+	}
+
+	if _, err := db.Import(writeTestExport(t, validExportHeader(), record), true); err != nil {
+		t.Fatalf("Import() = %v", err)
+	}
+	if installation, err := db.GetInstallation(1); err != nil {
+		t.Fatalf("GetInstallation() = %v", err)
+	} else if installation.Owner != "bob" {
+		t.Errorf("installation owner = %q, want %q", installation.Owner, "bob")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := openMigratedTestDB(t, nil)
+	if err := src.StoreInstallation(&Installation{ID: 1, Owner: "alice"}); err != nil {
+		t.Fatalf("StoreInstallation() = %v", err)
+	}
+	job := &Job{ID: 42, InstallationID: 1, Repo: "alice/repo", Commit: "abc", SubmittedAt: time.Now()}
+	if err := src.StoreJob(job); err != nil {
+		t.Fatalf("StoreJob() = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := src.Export(&buf, false); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+
+	dst := openMigratedTestDB(t, nil)
+	if _, err := dst.Import(&buf, false); err != nil {
+		t.Fatalf("Import() = %v", err)
+	}
+	if _, err := dst.GetInstallation(1); err != nil {
+		t.Errorf("GetInstallation() = %v", err)
+	}
+
+	// The job index is rebuilt on import
+	jobs, err := dst.ListJobs(&JobQuery{Repo: "alice/repo"})
+	if err != nil {
+		t.Fatalf("ListJobs() = %v", err)
+	} else if len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("ListJobs() = %v jobs, want job #%v", len(jobs), job.ID)
+	}
+}
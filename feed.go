@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-github/v56/github"
+)
+
+// feedSize is the number of jobs listed in a feed.
+const feedSize = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Links   []atomLink  `xml:"link"`
+	Summary string      `xml:"summary"`
+}
+
+// feedURL returns the URL of the feed of a repository, optionally filtered by
+// branch and status. Private repositories get a signed URL.
+func (srv *Server) feedURL(repo string, private bool, branch, status string) string {
+	q := make(url.Values)
+	if branch != "" {
+		q.Set("branch", branch)
+	}
+	if status != "" {
+		q.Set("status", status)
+	}
+	if private {
+		q.Set("token", srv.repoToken("feed", repo))
+	}
+	u := fmt.Sprintf("%v/%v/builds.atom", srv.publicURL, repo)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+func newAtomEntry(repo *github.Repository, job *Job) atomEntry {
+	view := newJobView(repo, job)
+
+	subject := job.Title
+	if subject == "" {
+		subject = job.Commit[:10]
+	}
+	title := fmt.Sprintf("%v: %v", job.Status, subject)
+	if name := manifestName(job.Manifest); name != "" {
+		title += fmt.Sprintf(" (%v)", name)
+	}
+
+	var ref string
+	if job.PullRequest != 0 {
+		ref = fmt.Sprintf("pull request #%v", job.PullRequest)
+	} else if job.MergeGroup {
+		ref = "merge queue"
+	} else if job.Branch != "" {
+		ref = "branch " + job.Branch
+	}
+	summary := fmt.Sprintf("Job #%v for commit %v", job.ID, job.Commit[:10])
+	if ref != "" {
+		summary += " on " + ref
+	}
+	summary += fmt.Sprintf(" with manifest %v: %v", job.Manifest, job.Status)
+	if view.Duration != "" {
+		summary += " after " + view.Duration
+	}
+	summary += "."
+
+	entry := atomEntry{
+		ID:      job.DetailsURL,
+		Title:   title,
+		Updated: job.FinishedAt.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "alternate", Type: "text/html", Href: job.DetailsURL},
+			{Rel: "related", Type: "text/html", Href: view.CommitURL},
+		},
+		Summary: summary,
+	}
+	if job.Submitter != "" {
+		entry.Author = &atomPerson{Name: job.Submitter}
+	}
+	return entry
+}
+
+func (srv *Server) handleRepoFeed(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "repo")
+	q := r.URL.Query()
+
+	repo, err := srv.getInstalledRepo(ctx, owner, name)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Print(err)
+		http.Error(w, "failed to fetch repository", http.StatusInternalServerError)
+		return
+	}
+	// Feed readers can't log in: private repositories require a token
+	if repo.GetPrivate() && !srv.checkRepoToken("feed", repo.GetFullName(), q.Get("token")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	branch, status := q.Get("branch"), q.Get("status")
+	jobs, err := srv.db.ListJobs(&JobQuery{
+		Repo:     repo.GetFullName(),
+		Branch:   branch,
+		Status:   status,
+		Finished: true,
+		Limit:    feedSize,
+	})
+	if err != nil {
+		log.Printf("failed to list jobs for repository %v: %v", repo.GetFullName(), err)
+		http.Error(w, "failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	feed := atomFeed{
+		ID:      srv.publicURL + "/" + repo.GetFullName(),
+		Title:   repo.GetFullName() + " builds",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "hottub"},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: srv.feedURL(repo.GetFullName(), repo.GetPrivate(), branch, status)},
+			{Rel: "alternate", Type: "text/html", Href: repo.GetHTMLURL()},
+		},
+	}
+	var updated time.Time
+	for _, job := range jobs {
+		feed.Entries = append(feed.Entries, newAtomEntry(repo, job))
+		if job.FinishedAt.After(updated) {
+			updated = job.FinishedAt
+		}
+	}
+	if !updated.IsZero() {
+		feed.Updated = updated.UTC().Format(time.RFC3339)
+	}
+
+	cacheControl := "public"
+	if repo.GetPrivate() {
+		cacheControl = "private"
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", cacheControl+", max-age=300")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(&feed); err != nil {
+		log.Printf("failed to write feed: %v", err)
+	}
+}
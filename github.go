@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/emersion/go-oauth2"
 	"github.com/google/go-github/v56/github"
 )
 
@@ -21,7 +30,277 @@ func createAppsTransport(appIDStr, privateKeyFilename string) *ghinstallation.Ap
 	return atr
 }
 
-func newInstallationClient(atr *ghinstallation.AppsTransport, installation *github.Installation) *github.Client {
-	itr := ghinstallation.NewFromAppsTransport(atr, *installation.ID)
+const (
+	installedRepoCacheTTL  = 5 * time.Minute
+	installedRepoCacheSize = 4096
+)
+
+// githubCache caches GitHub data used to serve unauthenticated requests, e.g.
+// badges embedded in READMEs, so that they don't exhaust the rate limit of the
+// app.
+type githubCache struct {
+	atr *ghinstallation.AppsTransport
+
+	mutex      sync.Mutex
+	transports map[int64]*ghinstallation.Transport
+	repos      map[string]cachedRepo // by lower-case full name
+}
+
+type cachedRepo struct {
+	repo      *github.Repository // nil if the app isn't installed
+	expiresAt time.Time
+}
+
+func newGitHubCache(atr *ghinstallation.AppsTransport) *githubCache {
+	return &githubCache{
+		atr:        atr,
+		transports: make(map[int64]*ghinstallation.Transport),
+		repos:      make(map[string]cachedRepo),
+	}
+}
+
+// installationClient returns a GitHub client authenticated as an
+// installation. Transports are kept around to re-use access tokens until they
+// expire.
+func (cache *githubCache) installationClient(id int64) *github.Client {
+	cache.mutex.Lock()
+	itr, ok := cache.transports[id]
+	if !ok {
+		itr = ghinstallation.NewFromAppsTransport(cache.atr, id)
+		cache.transports[id] = itr
+	}
+	cache.mutex.Unlock()
+
 	return github.NewClient(&http.Client{Transport: itr})
 }
+
+func (cache *githubCache) getRepo(fullName string) (repo *github.Repository, ok bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.repos[strings.ToLower(fullName)]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.repo, true
+}
+
+func (cache *githubCache) putRepo(fullName string, repo *github.Repository) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+	if len(cache.repos) >= installedRepoCacheSize {
+		for k, entry := range cache.repos {
+			if now.After(entry.expiresAt) {
+				delete(cache.repos, k)
+			}
+		}
+	}
+	if len(cache.repos) >= installedRepoCacheSize {
+		cache.repos = make(map[string]cachedRepo)
+	}
+
+	cache.repos[strings.ToLower(fullName)] = cachedRepo{
+		repo:      repo,
+		expiresAt: now.Add(installedRepoCacheTTL),
+	}
+}
+
+// installationPermissions converts GitHub installation permissions into a map
+// suitable for storage.
+func installationPermissions(installation *github.Installation) map[string]string {
+	if installation.Permissions == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(installation.Permissions)
+	if err != nil {
+		panic(err) // unreachable
+	}
+	var perms map[string]string
+	if err := json.Unmarshal(b, &perms); err != nil {
+		panic(err) // unreachable
+	}
+	return perms
+}
+
+// listRepoTeams returns the slugs of the teams with access to a repository.
+func listRepoTeams(ctx context.Context, gh *github.Client, owner, repo string) ([]string, error) {
+	var slugs []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		teams, resp, err := gh.Repositories.ListTeams(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, team := range teams {
+			slugs = append(slugs, team.GetSlug())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return slugs, nil
+}
+
+// getInstalledRepo fetches a repository the app is installed on.
+// ErrNotFound is returned if the app isn't installed on the repository.
+// Results are cached for a few minutes. The returned repository must not be
+// modified.
+func (srv *Server) getInstalledRepo(ctx context.Context, owner, name string) (*github.Repository, error) {
+	fullName := owner + "/" + name
+	if repo, ok := srv.github.getRepo(fullName); ok {
+		if repo == nil {
+			return nil, ErrNotFound
+		}
+		return repo, nil
+	}
+
+	ghInstallation, resp, err := srv.agh.Apps.FindRepositoryInstallation(ctx, owner, name)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		srv.github.putRepo(fullName, nil)
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find installation for repository %v: %v", fullName, err)
+	}
+
+	gh := srv.github.installationClient(ghInstallation.GetID())
+	repo, resp, err := gh.Repositories.Get(ctx, owner, name)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		srv.github.putRepo(fullName, nil)
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch repository %v: %v", fullName, err)
+	}
+	srv.github.putRepo(fullName, repo)
+	return repo, nil
+}
+
+// hasWriteAccess checks whether a user can push to a repository.
+func hasWriteAccess(ctx context.Context, gh *github.Client, owner, repo, user string) (bool, error) {
+	level, _, err := gh.Repositories.GetPermissionLevel(ctx, owner, repo, user)
+	if err != nil {
+		return false, err
+	}
+	switch level.GetPermission() {
+	case "admin", "write":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// listUserInstallations returns the installations of the app the user has
+// access to. gh must be authenticated as the user.
+func listUserInstallations(ctx context.Context, gh *github.Client) ([]*github.Installation, error) {
+	var l []*github.Installation
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		installations, resp, err := gh.Apps.ListUserInstallations(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, installations...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return l, nil
+}
+
+// listUserInstallationRepos returns the repositories of an installation the
+// user has access to. gh must be authenticated as the user.
+func listUserInstallationRepos(ctx context.Context, gh *github.Client, installationID int64) ([]*github.Repository, error) {
+	var l []*github.Repository
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		repos, resp, err := gh.Apps.ListUserRepos(ctx, installationID, opts)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, repos.Repositories...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return l, nil
+}
+
+const (
+	githubAuthorizeURL = "https://github.com/login/oauth/authorize"
+	githubTokenURL     = "https://github.com/login/oauth/access_token"
+)
+
+// githubOAuth2Client obtains user access tokens for the GitHub app via the
+// web application flow.
+type githubOAuth2Client struct {
+	ClientID     string
+	ClientSecret string
+}
+
+func (c *githubOAuth2Client) AuthorizationURL(state string) string {
+	q := make(url.Values)
+	q.Set("client_id", c.ClientID)
+	q.Set("state", state)
+	return githubAuthorizeURL + "?" + q.Encode()
+}
+
+// Exchange exchanges an authorization code for a user access token.
+//
+// GitHub doesn't accept client credentials in the Authorization header and
+// returns errors with a 200 status code, so the generic OAuth2 client can't
+// be used.
+func (c *githubOAuth2Client) Exchange(ctx context.Context, code string) (*oauth2.TokenResp, error) {
+	params := make(url.Values)
+	params.Set("client_id", c.ClientID)
+	params.Set("client_secret", c.ClientSecret)
+	params.Set("code", code)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, githubTokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+
+	var errResp struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		return nil, err
+	} else if errResp.Error != "" {
+		return nil, fmt.Errorf("%v: %v", errResp.Error, errResp.ErrorDescription)
+	}
+
+	var tokenResp oauth2.TokenResp
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, err
+	}
+	if tokenResp.TokenType != oauth2.TokenTypeBearer {
+		return nil, fmt.Errorf("unsupported OAuth2 token type %q", tokenResp.TokenType)
+	}
+	return &tokenResp, nil
+}
+
+func newUserClient(token string) *github.Client {
+	return github.NewClient(nil).WithAuthToken(token)
+}
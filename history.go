@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-github/v56/github"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+// historyPageSize is the number of jobs displayed per history page.
+const historyPageSize = 50
+
+// jobView is a job decorated for display.
+type jobView struct {
+	*Job
+	CommitURL      string
+	PullRequestURL string
+	Duration       string
+}
+
+func newJobView(repo *github.Repository, job *Job) *jobView {
+	view := &jobView{
+		Job:       job,
+		CommitURL: repo.GetHTMLURL() + "/commit/" + job.Commit,
+	}
+	if job.PullRequest != 0 {
+		view.PullRequestURL = fmt.Sprintf("%v/pull/%v", repo.GetHTMLURL(), job.PullRequest)
+	}
+	if !job.FinishedAt.IsZero() {
+		view.Duration = job.FinishedAt.Sub(job.SubmittedAt).Round(time.Second).String()
+	}
+	return view
+}
+
+// authorizeRepo checks that the user is allowed to view a repository's
+// builds. Anyone can view public repositories, private repositories require
+// the user to have read access. It returns nil if a response has already been
+// written.
+func (srv *Server) authorizeRepo(w http.ResponseWriter, r *http.Request) *github.Repository {
+	ctx := r.Context()
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "repo")
+
+	repo, err := srv.getInstalledRepo(ctx, owner, name)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return nil
+	} else if err != nil {
+		log.Print(err)
+		http.Error(w, "failed to fetch repository", http.StatusInternalServerError)
+		return nil
+	}
+	if !repo.GetPrivate() {
+		return repo
+	}
+
+	if !srv.requireRepoAccess(w, r, repo, false) {
+		return nil
+	}
+	return repo
+}
+
+// requireRepoAccess checks that the user performing the request is logged in
+// and has read access to a repository, or write access if write is set. It
+// returns false if a response has already been written.
+func (srv *Server) requireRepoAccess(w http.ResponseWriter, r *http.Request, repo *github.Repository, write bool) bool {
+	session := srv.requireSession(w, r)
+	if session == nil {
+		return false
+	}
+	// Users without read access get a 404 from GitHub
+	userRepo, resp, err := session.GitHub().Repositories.Get(r.Context(), repo.GetOwner().GetLogin(), repo.GetName())
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		http.NotFound(w, r)
+		return false
+	} else if err != nil {
+		log.Printf("failed to fetch repository %v for %v: %v", repo.GetFullName(), session.GitHubLogin, err)
+		http.Error(w, "failed to fetch repository", http.StatusInternalServerError)
+		return false
+	}
+	if write && !userRepo.GetPermissions()["push"] {
+		http.NotFound(w, r)
+		return false
+	}
+	return true
+}
+
+func (srv *Server) handleRepoHistory(w http.ResponseWriter, r *http.Request) {
+	repo := srv.authorizeRepo(w, r)
+	if repo == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	query := JobQuery{
+		Repo:   repo.GetFullName(),
+		Branch: q.Get("branch"),
+		Status: q.Get("status"),
+		Limit:  historyPageSize + 1,
+	}
+	if s := q.Get("pr"); s != "" {
+		pr, err := strconv.Atoi(s)
+		if err != nil || pr <= 0 {
+			http.Error(w, "invalid pr parameter", http.StatusBadRequest)
+			return
+		}
+		query.PullRequest = pr
+	}
+	if s := q.Get("before"); s != "" {
+		before, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || before <= 0 {
+			http.Error(w, "invalid before parameter", http.StatusBadRequest)
+			return
+		}
+		query.Before = int32(before)
+	}
+
+	jobs, err := srv.db.ListJobs(&query)
+	if err != nil {
+		log.Printf("failed to list jobs for repository %v: %v", repo.GetFullName(), err)
+		http.Error(w, "failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	var nextURL string
+	if len(jobs) > historyPageSize {
+		jobs = jobs[:historyPageSize]
+		next := make(url.Values)
+		for k, v := range q {
+			next[k] = v
+		}
+		next.Set("before", strconv.Itoa(int(jobs[len(jobs)-1].ID)))
+		nextURL = "?" + next.Encode()
+	}
+
+	views := make([]*jobView, len(jobs))
+	for i, job := range jobs {
+		views[i] = newJobView(repo, job)
+	}
+
+	data := struct {
+		Repo     *github.Repository
+		Jobs     []*jobView
+		Query    *JobQuery
+		Statuses []buildssrht.JobStatus
+		NextURL  string
+		FirstURL string
+		FeedURL  string
+	}{
+		Repo:  repo,
+		Jobs:  views,
+		Query: &query,
+		Statuses: []buildssrht.JobStatus{
+			buildssrht.JobStatusPending,
+			buildssrht.JobStatusQueued,
+			buildssrht.JobStatusRunning,
+			buildssrht.JobStatusSuccess,
+			buildssrht.JobStatusFailed,
+			buildssrht.JobStatusTimeout,
+			buildssrht.JobStatusCancelled,
+		},
+		NextURL: nextURL,
+		FeedURL: srv.feedURL(repo.GetFullName(), repo.GetPrivate(), query.Branch, query.Status),
+	}
+	if query.Before != 0 {
+		first := make(url.Values)
+		for k, v := range q {
+			first[k] = v
+		}
+		first.Del("before")
+		data.FirstURL = "?" + first.Encode()
+	}
+	srv.renderTemplate(w, "history.html", &data)
+}
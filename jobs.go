@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+var (
+	jobsBucket     = []byte("jobs")
+	jobIndexBucket = []byte("job_index")
+)
+
+// Job is a sr.ht job submitted by hottub.
+type Job struct {
+	ID             int32                 `json:"id"`
+	InstallationID int64                 `json:"installation_id"`
+	Repo           string                `json:"repo"`
+	Commit         string                `json:"commit"`
+	Title          string                `json:"title,omitempty"` // first line of the commit message
+	Branch         string                `json:"branch,omitempty"`
+	PullRequest    int                   `json:"pull_request,omitempty"`
+	MergeGroup     bool                  `json:"merge_group,omitempty"`
+	Manifest       string                `json:"manifest"`
+	DetailsURL     string                `json:"details_url"`
+	Submitter      string                `json:"submitter,omitempty"` // GitHub login
+	SrhtUsername   string                `json:"srht_username,omitempty"`
+	Secrets        bool                  `json:"secrets"`
+	Visibility     buildssrht.Visibility `json:"visibility,omitempty"`
+	StatusContext  string                `json:"status_context,omitempty"` // GitHub commit status or check run name
+	CheckRunID     int64                 `json:"check_run_id,omitempty"`
+	Status         string                `json:"status"`
+	SubmittedAt    time.Time             `json:"submitted_at"`
+	UpdatedAt      time.Time             `json:"updated_at"`
+	FinishedAt     time.Time             `json:"finished_at,omitempty"`
+}
+
+// JobQuery filters the job history. Zero fields match all jobs.
+type JobQuery struct {
+	InstallationID int64
+	Repo           string
+	PullRequest    int
+	Commit         string
+	Branch         string
+	Manifest       string // path or name
+	Status         string
+	Finished       bool // only return finished jobs
+	Limit          int
+	Before         int32 // only return jobs with a lower ID
+}
+
+func (query *JobQuery) matches(job *Job) bool {
+	if query.InstallationID != 0 && query.InstallationID != job.InstallationID {
+		return false
+	}
+	if query.Repo != "" && !strings.EqualFold(query.Repo, job.Repo) {
+		return false
+	}
+	if query.PullRequest != 0 && query.PullRequest != job.PullRequest {
+		return false
+	}
+	if query.Commit != "" && !strings.HasPrefix(job.Commit, query.Commit) {
+		return false
+	}
+	if query.Branch != "" && query.Branch != job.Branch {
+		return false
+	}
+	if query.Manifest != "" && query.Manifest != job.Manifest && query.Manifest != manifestName(job.Manifest) {
+		return false
+	}
+	if query.Status != "" && !strings.EqualFold(query.Status, job.Status) {
+		return false
+	}
+	if query.Finished && job.FinishedAt.IsZero() {
+		return false
+	}
+	return true
+}
+
+// jobIndexKeys returns the index keys of a job. Keys are composed of a
+// prefix identifying the indexed value followed by the job ID, so that jobs
+// are sorted by ID for each prefix.
+func jobIndexKeys(job *Job) [][]byte {
+	repo := strings.ToLower(job.Repo)
+	prefixes := []string{
+		"repo:" + repo,
+		"commit:" + job.Commit,
+	}
+	if job.PullRequest != 0 {
+		prefixes = append(prefixes, "pr:"+repo+"#"+strconv.Itoa(job.PullRequest))
+	}
+
+	keys := make([][]byte, len(prefixes))
+	for i, prefix := range prefixes {
+		keys[i] = jobIndexKey(prefix, job.ID)
+	}
+	return keys
+}
+
+func jobIndexKey(prefix string, id int32) []byte {
+	return append([]byte(prefix+"\x00"), marshalJobID(id)...)
+}
+
+// indexPrefix returns the index prefix to use to look up jobs matching the
+// query, or an empty string if the whole history needs to be scanned.
+func (query *JobQuery) indexPrefix() string {
+	switch {
+	case len(query.Commit) == 40:
+		return "commit:" + query.Commit
+	case query.Repo != "" && query.PullRequest != 0:
+		return "pr:" + strings.ToLower(query.Repo) + "#" + strconv.Itoa(query.PullRequest)
+	case query.Repo != "":
+		return "repo:" + strings.ToLower(query.Repo)
+	default:
+		return ""
+	}
+}
+
+func marshalJobID(id int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(id))
+	return b
+}
+
+// StoreJob creates or updates a job history record.
+func (db *DB) StoreJob(job *Job) error {
+	job.UpdatedAt = time.Now()
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(jobsBucket).Put(marshalJobID(job.ID), b); err != nil {
+			return err
+		}
+		return indexJob(tx, job)
+	})
+}
+
+// StoreReusedJob records that a job has been re-used for another check suite
+// of the same commit. The branch, pull request and merge queue of the check
+// suite are added to the existing record if it lacks them, so that the job
+// shows up in their history. The job is created if there is no record yet. On
+// return, job contains the stored record.
+func (db *DB) StoreReusedJob(job *Job) error {
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		existing, err := getJob(tx, job.ID)
+		if err == nil {
+			if existing.Branch == "" {
+				existing.Branch = job.Branch
+			}
+			if existing.PullRequest == 0 {
+				existing.PullRequest = job.PullRequest
+			}
+			existing.MergeGroup = existing.MergeGroup || job.MergeGroup
+			*job = *existing
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		job.UpdatedAt = time.Now()
+		b, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(jobsBucket).Put(marshalJobID(job.ID), b); err != nil {
+			return err
+		}
+		return indexJob(tx, job)
+	})
+}
+
+func indexJob(tx *bbolt.Tx, job *Job) error {
+	index := tx.Bucket(jobIndexBucket)
+	for _, k := range jobIndexKeys(job) {
+		if err := index.Put(k, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) GetJob(id int32) (*Job, error) {
+	var job *Job
+	err := db.View(func(tx *bbolt.Tx) error {
+		var err error
+		job, err = getJob(tx, id)
+		return err
+	})
+	return job, err
+}
+
+func getJob(tx *bbolt.Tx, id int32) (*Job, error) {
+	b := tx.Bucket(jobsBucket).Get(marshalJobID(id))
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	job := new(Job)
+	if err := json.Unmarshal(b, job); err != nil {
+		return nil, fmt.Errorf("failed to decode job #%v: %v", id, err)
+	}
+	return job, nil
+}
+
+// UpdateJobStatus records the latest status of a job.
+func (db *DB) UpdateJobStatus(id int32, status string, finished bool) error {
+	return db.UpdateJob(id, func(job *Job) {
+		job.Status = status
+		if finished {
+			job.FinishedAt = time.Now()
+		}
+	})
+}
+
+// UpdateJob reads a job record, calls fn to modify it and stores the result.
+// Fields used by the index must not be modified.
+func (db *DB) UpdateJob(id int32, fn func(job *Job)) error {
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		job, err := getJob(tx, id)
+		if err != nil {
+			return err
+		}
+
+		fn(job)
+		job.UpdatedAt = time.Now()
+
+		b, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(jobsBucket).Put(marshalJobID(id), b)
+	})
+}
+
+// JobCounts contains the number of jobs submitted for an installation.
+type JobCounts struct {
+	Total  int
+	Recent int // submitted after the time passed to CountJobs
+}
+
+// CountJobs returns the number of jobs submitted for each installation.
+func (db *DB) CountJobs(since time.Time) (map[int64]*JobCounts, error) {
+	counts := make(map[int64]*JobCounts)
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("failed to decode job #%v: %v", binary.BigEndian.Uint32(k), err)
+			}
+			c := counts[job.InstallationID]
+			if c == nil {
+				c = new(JobCounts)
+				counts[job.InstallationID] = c
+			}
+			c.Total++
+			if job.SubmittedAt.After(since) {
+				c.Recent++
+			}
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// ListJobs returns the jobs matching a query, most recent first.
+func (db *DB) ListJobs(query *JobQuery) ([]*Job, error) {
+	var l []*Job
+	err := db.View(func(tx *bbolt.Tx) error {
+		add := func(job *Job) bool {
+			if query.matches(job) {
+				l = append(l, job)
+			}
+			return query.Limit <= 0 || len(l) < query.Limit
+		}
+
+		prefix := query.indexPrefix()
+		if prefix == "" {
+			c := tx.Bucket(jobsBucket).Cursor()
+			var k, v []byte
+			if query.Before != 0 {
+				k, _ = c.Seek(marshalJobID(query.Before))
+			}
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			for ; k != nil; k, v = c.Prev() {
+				job := new(Job)
+				if err := json.Unmarshal(v, job); err != nil {
+					return fmt.Errorf("failed to decode job #%v: %v", binary.BigEndian.Uint32(k), err)
+				}
+				if !add(job) {
+					break
+				}
+			}
+			return nil
+		}
+
+		c := tx.Bucket(jobIndexBucket).Cursor()
+		prefixBytes := []byte(prefix + "\x00")
+		var k []byte
+		if query.Before != 0 {
+			k, _ = c.Seek(jobIndexKey(prefix, query.Before))
+		} else {
+			// Seek right after the last key with the prefix
+			k, _ = c.Seek([]byte(prefix + "\x01"))
+		}
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefixBytes); k, _ = c.Prev() {
+			id := int32(binary.BigEndian.Uint32(k[len(prefixBytes):]))
+			job, err := getJob(tx, id)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !add(job) {
+				break
+			}
+		}
+		return nil
+	})
+	return l, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks encrypted values stored in the DB. Encrypted values
+// have the form "enc:<key ID>:<base64 nonce and ciphertext>".
+const encryptedPrefix = "enc:"
+
+// keyring holds the keys used to encrypt secrets stored in the DB.
+type keyring struct {
+	primary string // ID of the key used for encryption
+	aeads   map[string]cipher.AEAD
+}
+
+// loadKeyring reads a key file. Each line contains a key ID and a
+// base64-encoded 256-bit key, separated by a space. The first key is used to
+// encrypt new values, the other ones are only used for decryption. Empty
+// lines and lines starting with "#" are ignored.
+func loadKeyring(filename string) (*keyring, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kr := &keyring{aeads: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected a key ID and a key", filename, lineno)
+		}
+		id, encodedKey := fields[0], fields[1]
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("%v:%v: key ID must not contain a colon", filename, lineno)
+		}
+		if _, ok := kr.aeads[id]; ok {
+			return nil, fmt.Errorf("%v:%v: duplicate key ID %q", filename, lineno, id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: invalid base64 key: %v", filename, lineno, err)
+		} else if len(key) != 32 {
+			return nil, fmt.Errorf("%v:%v: key must be 32 bytes long, got %v", filename, lineno, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		kr.aeads[id] = aead
+		if kr.primary == "" {
+			kr.primary = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if kr.primary == "" {
+		return nil, fmt.Errorf("%v: no key found", filename)
+	}
+	return kr, nil
+}
+
+// Encrypt seals a value with the primary key. additionalData binds the
+// ciphertext to its context, e.g. the record it belongs to.
+func (kr *keyring) Encrypt(plaintext string, additionalData []byte) (string, error) {
+	aead := kr.aeads[kr.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), additionalData)
+	return encryptedPrefix + kr.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (kr *keyring) Decrypt(ciphertext string, additionalData []byte) (string, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(ciphertext, encryptedPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	aead, ok := kr.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key ID %q", keyID)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	} else if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value: too short")
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value with key %q: %v", keyID, err)
+	}
+	return string(plaintext), nil
+}
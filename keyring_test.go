@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testKey1 = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testKey2 = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func writeTestKeyring(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	return filename
+}
+
+func loadTestKeyring(t *testing.T, content string) *keyring {
+	t.Helper()
+	kr, err := loadKeyring(writeTestKeyring(t, content))
+	if err != nil {
+		t.Fatalf("loadKeyring() = %v", err)
+	}
+	return kr
+}
+
+func TestLoadKeyring(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantPrimary string
+		wantErr     string
+	}{
+		{"single", "k1 " + testKey1 + "\n", "k1", ""},
+		{"multiple", "# new key\nk2 " + testKey2 + "\n\nk1 " + testKey1 + "\n", "k2", ""},
+		{"empty", "# no key\n", "", "no key found"},
+		{"missing key", "k1\n", "", "expected a key ID and a key"},
+		{"extra field", "k1 " + testKey1 + " x\n", "", "expected a key ID and a key"},
+		{"colon", "k:1 " + testKey1 + "\n", "", "must not contain a colon"},
+		{"duplicate", "k1 " + testKey1 + "\nk1 " + testKey2 + "\n", "", "duplicate key ID"},
+		{"base64", "k1 not-base64!\n", "", "invalid base64 key"},
+		{"length", "k1 " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n", "", "must be 32 bytes long"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kr, err := loadKeyring(writeTestKeyring(t, tc.content))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("loadKeyring() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadKeyring() = %v", err)
+			}
+			if kr.primary != tc.wantPrimary {
+				t.Errorf("primary key = %q, want %q", kr.primary, tc.wantPrimary)
+			}
+		})
+	}
+}
+
+func TestLoadKeyring_missingFile(t *testing.T) {
+	if _, err := loadKeyring(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("loadKeyring() = %v, want a not-exist error", err)
+	}
+}
+
+func TestKeyring_roundTrip(t *testing.T) {
+	kr := loadTestKeyring(t, "k1 "+testKey1+"\n")
+	ciphertext, err := kr.Encrypt("secret", []byte("installation:1"))
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	if !strings.HasPrefix(ciphertext, encryptedPrefix+"k1:") {
+		t.Errorf("Encrypt() = %q, want prefix %q", ciphertext, encryptedPrefix+"k1:")
+	}
+	if strings.Contains(ciphertext, "secret") {
+		t.Errorf("Encrypt() = %q, contains the plaintext", ciphertext)
+	}
+
+	if plaintext, err := kr.Decrypt(ciphertext, []byte("installation:1")); err != nil {
+		t.Errorf("Decrypt() = %v", err)
+	} else if plaintext != "secret" {
+		t.Errorf("Decrypt() = %q, want %q", plaintext, "secret")
+	}
+	if _, err := kr.Decrypt(ciphertext, []byte("installation:2")); err == nil {
+		t.Errorf("Decrypt() succeeded with the wrong additional data")
+	}
+}
+
+func TestKeyring_rotation(t *testing.T) {
+	old := loadTestKeyring(t, "k1 "+testKey1+"\n")
+	ciphertext, err := old.Encrypt("secret", nil)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+
+	// Values encrypted with an old key can still be decrypted
+	rotated := loadTestKeyring(t, "k2 "+testKey2+"\nk1 "+testKey1+"\n")
+	if plaintext, err := rotated.Decrypt(ciphertext, nil); err != nil {
+		t.Errorf("Decrypt() = %v", err)
+	} else if plaintext != "secret" {
+		t.Errorf("Decrypt() = %q, want %q", plaintext, "secret")
+	}
+
+	// New values are encrypted with the new key
+	if ciphertext, err := rotated.Encrypt("secret", nil); err != nil {
+		t.Errorf("Encrypt() = %v", err)
+	} else if !strings.HasPrefix(ciphertext, encryptedPrefix+"k2:") {
+		t.Errorf("Encrypt() = %q, want prefix %q", ciphertext, encryptedPrefix+"k2:")
+	}
+
+	// Values can't be decrypted once the old key has been removed
+	removed := loadTestKeyring(t, "k2 "+testKey2+"\n")
+	if _, err := removed.Decrypt(ciphertext, nil); err == nil {
+		t.Errorf("Decrypt() succeeded without the key")
+	}
+}
+
+func TestKeyring_decryptMalformed(t *testing.T) {
+	kr := loadTestKeyring(t, "k1 "+testKey1+"\n")
+	tests := []string{
+		"enc:",
+		"enc:k1",
+		"enc:k1:not base64",
+		"enc:k1:AAAA",
+		"enc:unknown:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+	}
+	for _, ciphertext := range tests {
+		if _, err := kr.Decrypt(ciphertext, nil); err == nil {
+			t.Errorf("Decrypt(%q) succeeded", ciphertext)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-github/v56/github"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+const (
+	logPollInterval = 3 * time.Second
+	// logStreamDuration is how long a log stream is kept open. Requests are
+	// limited to 60 seconds by the timeout middleware: clients reconnect
+	// and resume from the Last-Event-ID header.
+	logStreamDuration = 45 * time.Second
+	// logMaxChunkSize is the maximum amount of log sent per poll.
+	logMaxChunkSize = 256 * 1024
+)
+
+// jobPageURL returns the URL of the page displaying the logs of a job.
+func (srv *Server) jobPageURL(repo string, id int32) string {
+	return fmt.Sprintf("%v/%v/jobs/%v", srv.publicURL, repo, id)
+}
+
+// jobSrhtClient returns a sr.ht client for the account which submitted a job.
+func (srv *Server) jobSrhtClient(job *Job) (*SrhtClient, error) {
+	installation, err := srv.db.GetInstallation(job.InstallationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get installation %v: %v", job.InstallationID, err)
+	}
+	creds := installation.srhtCredentialsByUsername(job.SrhtUsername)
+	if creds == nil || creds.SrhtToken == "" {
+		return nil, fmt.Errorf("sr.ht account %q isn't linked anymore", job.SrhtUsername)
+	}
+	return createSrhtClient(srv.buildssrhtEndpoint, srv.srhtOAuth2Client, creds), nil
+}
+
+// authorizeJob checks that the user is allowed to view a job, with the same
+// rules as the build history. Unlisted and private jobs of public
+// repositories are only visible to collaborators. It returns nil if a
+// response has already been written.
+func (srv *Server) authorizeJob(w http.ResponseWriter, r *http.Request) (*github.Repository, *Job) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+
+	repo := srv.authorizeRepo(w, r)
+	if repo == nil {
+		return nil, nil
+	}
+
+	job, err := srv.db.GetJob(int32(id))
+	if err == ErrNotFound || (err == nil && !strings.EqualFold(job.Repo, repo.GetFullName())) {
+		http.NotFound(w, r)
+		return nil, nil
+	} else if err != nil {
+		log.Printf("failed to get job #%v: %v", id, err)
+		http.Error(w, "failed to get job", http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	// Jobs recorded without a visibility are assumed to be non-public
+	if !repo.GetPrivate() && job.Visibility != buildssrht.VisibilityPublic && !srv.requireRepoAccess(w, r, repo, true) {
+		return nil, nil
+	}
+	return repo, job
+}
+
+func (srv *Server) handleJobPage(w http.ResponseWriter, r *http.Request) {
+	repo, job := srv.authorizeJob(w, r)
+	if job == nil {
+		return
+	}
+
+	data := struct {
+		Repo      *github.Repository
+		Job       *jobView
+		StreamURL string
+	}{
+		Repo:      repo,
+		Job:       newJobView(repo, job),
+		StreamURL: fmt.Sprintf("/%v/jobs/%v/log", repo.GetFullName(), job.ID),
+	}
+	srv.renderTemplate(w, "job.html", &data)
+}
+
+// jobLog is a log file of a sr.ht job: the setup log or the log of a task.
+type jobLog struct {
+	Name string
+	URL  string
+	Done bool // no more output will be appended
+}
+
+func isJobFinished(job *buildssrht.Job) bool {
+	switch job.Status {
+	case buildssrht.JobStatusPending, buildssrht.JobStatusQueued, buildssrht.JobStatusRunning:
+		return false
+	default:
+		return true
+	}
+}
+
+func listJobLogs(job *buildssrht.Job) []jobLog {
+	jobDone := isJobFinished(job)
+
+	var logs []jobLog
+	if job.Log != nil {
+		// The setup log is complete once the first task has started
+		done := jobDone || (len(job.Tasks) > 0 && job.Tasks[0].Status != buildssrht.TaskStatusPending)
+		logs = append(logs, jobLog{Name: "setup", URL: job.Log.FullURL, Done: done})
+	}
+	for _, task := range job.Tasks {
+		if task.Log == nil {
+			continue
+		}
+		done := jobDone || (task.Status != buildssrht.TaskStatusPending && task.Status != buildssrht.TaskStatusRunning)
+		logs = append(logs, jobLog{Name: task.Name, URL: task.Log.FullURL, Done: done})
+	}
+	return logs
+}
+
+// fetchLogChunk fetches the part of a log starting at offset. Unless the log
+// is done, the returned chunk only contains complete lines.
+func fetchLogChunk(ctx context.Context, client *http.Client, l *jobLog, offset int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// The server honored the range
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+			return nil, nil // the log is shorter than the offset
+		}
+	case http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil // the log hasn't been written yet
+	default:
+		return nil, fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+
+	chunk, err := io.ReadAll(io.LimitReader(resp.Body, logMaxChunkSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) == logMaxChunkSize || !l.Done {
+		// Don't cut lines in half, unless a single line exceeds the maximum
+		// chunk size. In that case, only avoid cutting a UTF-8 sequence.
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 || len(chunk) < logMaxChunkSize {
+			chunk = chunk[:i+1]
+		} else {
+			chunk = trimIncompleteRune(chunk)
+		}
+	}
+	return chunk, nil
+}
+
+// trimIncompleteRune removes a truncated UTF-8 sequence at the end of b.
+func trimIncompleteRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// parseLogOffsets parses a Last-Event-ID header: a comma-separated list of
+// offsets in each log.
+func parseLogOffsets(s string) []int {
+	var offsets []int
+	if s == "" {
+		return nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		offset, err := strconv.Atoi(field)
+		if err != nil || offset < 0 {
+			return nil
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+func formatLogOffsets(offsets []int) string {
+	l := make([]string, len(offsets))
+	for i, offset := range offsets {
+		l[i] = strconv.Itoa(offset)
+	}
+	return strings.Join(l, ",")
+}
+
+type logEvent struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Text  string `json:"text"`
+}
+
+// handleJobLogStream streams the logs of a job via Server-Sent Events. The
+// logs are polled with the token of the account which submitted the job, so
+// that users with access to the repository can see logs of private jobs.
+func (srv *Server) handleJobLogStream(w http.ResponseWriter, r *http.Request) {
+	_, job := srv.authorizeJob(w, r)
+	if job == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	srht, err := srv.jobSrhtClient(job)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "failed to fetch job logs", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	offsets := parseLogOffsets(r.Header.Get("Last-Event-ID"))
+	deadline := time.Now().Add(logStreamDuration)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %v\n\n", logPollInterval.Milliseconds())
+	flusher.Flush()
+
+	var prevStatus buildssrht.JobStatus
+	for {
+		srhtJob, err := buildssrht.FetchJobLogs(srht.GQL, ctx, job.ID)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("failed to fetch logs of sr.ht job #%v: %v", job.ID, err)
+			}
+			return
+		} else if srhtJob == nil {
+			fmt.Fprintf(w, "event: end\ndata: %v\n\n", job.Status)
+			flusher.Flush()
+			return
+		}
+
+		logs := listJobLogs(srhtJob)
+		sent := false
+		for i := range logs {
+			if i >= len(offsets) {
+				offsets = append(offsets, 0)
+			}
+			chunk, err := fetchLogChunk(ctx, srht.HTTP, &logs[i], offsets[i])
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("failed to fetch %v log of sr.ht job #%v: %v", logs[i].Name, job.ID, err)
+				}
+				return
+			} else if len(chunk) == 0 {
+				continue
+			}
+			offsets[i] += len(chunk)
+			sent = true
+
+			data, err := json.Marshal(&logEvent{Index: i, Name: logs[i].Name, Text: string(chunk)})
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(w, "id: %v\nevent: log\ndata: %s\n\n", formatLogOffsets(offsets), data)
+		}
+
+		if srhtJob.Status != prevStatus {
+			prevStatus = srhtJob.Status
+			fmt.Fprintf(w, "event: status\ndata: %v\n\n", srhtJob.Status)
+		}
+
+		// Keep going until the logs of a finished job have been sent
+		// completely
+		finished := isJobFinished(srhtJob)
+		if finished && !sent {
+			fmt.Fprintf(w, "event: end\ndata: %v\n\n", srhtJob.Status)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		if time.Now().After(deadline) {
+			return
+		} else if finished {
+			continue
+		}
+		select {
+		case <-time.After(logPollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
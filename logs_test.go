@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTrimIncompleteRune(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"abcé", "abcé"},
+		{"abc€", "abc€"},
+		{"abc\U0001F600", "abc\U0001F600"},
+		{"abc" + "é"[:1], "abc"},
+		{"abc" + "€"[:2], "abc"},
+		{"abc" + "\U0001F600"[:3], "abc"},
+		// Invalid sequences are left as-is
+		{"abc\x80", "abc\x80"},
+	}
+	for _, tc := range tests {
+		if got := string(trimIncompleteRune([]byte(tc.in))); got != tc.want {
+			t.Errorf("trimIncompleteRune(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
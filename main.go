@@ -21,7 +21,6 @@ import (
 	"syscall"
 	"time"
 
-	"git.sr.ht/~emersion/gqlclient"
 	"github.com/emersion/go-oauth2"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -39,27 +38,49 @@ const (
 	maxJobsPerCheckSuite = 4
 )
 
-var (
-	TemplatesDir = "templates"
-	StaticDir    = "static"
-)
-
 var (
 	monitorContext   context.Context
 	monitorWaitGroup sync.WaitGroup
+	activeJobs       = newActiveJobSet()
 )
 
 func main() {
-	var addr, dbFilename, appID, privateKeyFilename, webhookSecret, buildssrhtEndpoint, metasrhtEndpoint, srhtClientID, srhtClientSecret string
+	if len(os.Args) > 1 {
+		switch cmd := os.Args[1]; cmd {
+		case "serve":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "rotate-key":
+			rotateKeyCommand(os.Args[2:])
+			return
+		case "installations", "jobs", "token", "db":
+			adminCommand(cmd, os.Args[2:])
+			return
+		}
+	}
+
+	var addr, publicURL, dbFilename, dbKeyFilename, appID, privateKeyFilename, webhookSecret, ghClientID, ghClientSecret, buildssrhtEndpoint, metasrhtEndpoint, srhtClientID, srhtClientSecret string
+	var admins, templatesDir, staticDir string
+	var webhookWorkers int
+	var dedupWindow, recoveryInterval time.Duration
 	flag.StringVar(&addr, "listen", ":3333", "listening address")
+	flag.StringVar(&publicURL, "public-url", "", "public URL of this instance, e.g. https://hottub.example.org")
 	flag.StringVar(&dbFilename, "db", "hottub.db", "database path")
+	flag.StringVar(&dbKeyFilename, "db-key", "", "database encryption key file (optional)")
 	flag.StringVar(&appID, "gh-app-id", "", "GitHub app ID")
 	flag.StringVar(&privateKeyFilename, "gh-private-key", "", "GitHub app private key path")
 	flag.StringVar(&webhookSecret, "gh-webhook-secret", "", "GitHub webhook secret")
+	flag.StringVar(&ghClientID, "gh-client-id", "", "GitHub app client ID")
+	flag.StringVar(&ghClientSecret, "gh-client-secret", "", "GitHub app client secret")
 	flag.StringVar(&buildssrhtEndpoint, "buildssrht-endpoint", "https://builds.sr.ht", "builds.sr.ht endpoint")
 	flag.StringVar(&metasrhtEndpoint, "metasrht-endpoint", "https://meta.sr.ht", "meta.sr.ht endpoint")
 	flag.StringVar(&srhtClientID, "metasrht-client-id", "", "meta.sr.ht OAuth2 client ID (optional)")
 	flag.StringVar(&srhtClientSecret, "metasrht-client-secret", "", "meta.sr.ht OAuth2 client secret (optional)")
+	flag.StringVar(&admins, "admins", "", "comma-separated list of GitHub logins allowed to access the admin page (optional)")
+	flag.StringVar(&templatesDir, "templates-dir", "", "directory of templates overriding the built-in ones (optional)")
+	flag.StringVar(&staticDir, "static-dir", "", "directory of static files overriding the built-in ones (optional)")
+	flag.IntVar(&webhookWorkers, "webhook-workers", 4, "number of webhook deliveries processed concurrently")
+	flag.DurationVar(&dedupWindow, "dedup-window", time.Hour, "time window in which identical builds are deduplicated (0 to disable)")
+	flag.DurationVar(&recoveryInterval, "webhook-recovery-interval", 15*time.Minute, "interval at which missed webhook deliveries are recovered (0 to disable)")
 	flag.Parse()
 
 	if appID == "" {
@@ -71,19 +92,45 @@ func main() {
 	if webhookSecret == "" {
 		webhookSecret = os.Getenv("GITHUB_WEBHOOK_SECRET")
 	}
+	if ghClientID == "" {
+		ghClientID = os.Getenv("GITHUB_CLIENT_ID")
+	}
+	if ghClientSecret == "" {
+		ghClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+	}
 	if srhtClientID == "" {
 		srhtClientID = os.Getenv("SRHT_CLIENT_ID")
 	}
 	if srhtClientSecret == "" {
 		srhtClientSecret = os.Getenv("SRHT_CLIENT_SECRET")
 	}
+	if dbKeyFilename == "" {
+		dbKeyFilename = os.Getenv("HOTTUB_DB_KEY")
+	}
 
 	if appID == "" || privateKeyFilename == "" {
 		log.Fatal("missing -gh-app-id or -gh-private-key")
 	}
+	if ghClientID == "" || ghClientSecret == "" {
+		log.Fatal("missing -gh-client-id or -gh-client-secret")
+	}
+	// Commit statuses link to pages of this instance
+	if publicURL == "" {
+		log.Fatal("missing -public-url")
+	} else if u, err := url.Parse(publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("invalid -public-url %q: must be an absolute HTTP(S) URL", publicURL)
+	}
 
 	atr := createAppsTransport(appID, privateKeyFilename)
-	db := createDB(dbFilename)
+	var kr *keyring
+	if dbKeyFilename != "" {
+		var err error
+		kr, err = loadKeyring(dbKeyFilename)
+		if err != nil {
+			log.Fatalf("failed to load database encryption keys: %v", err)
+		}
+	}
+	db := createDB(dbFilename, kr)
 
 	agh := github.NewClient(&http.Client{Transport: atr})
 	app, _, err := agh.Apps.Get(context.Background(), "")
@@ -96,15 +143,49 @@ func main() {
 		log.Fatalf("failed to create sr.ht OAuth2 client: %v", err)
 	}
 
-	tpl := template.Must(template.ParseGlob(TemplatesDir + "/*.html"))
+	tpl, err := loadTemplates(templatesDir)
+	if err != nil {
+		log.Fatalf("failed to load templates: %v", err)
+	}
+	staticFS, err := loadAssets(embeddedStatic, "static", staticDir)
+	if err != nil {
+		log.Fatalf("failed to load static files: %v", err)
+	}
+
+	badgeSecret, err := loadBadgeSecret(db)
+	if err != nil {
+		log.Fatalf("failed to load badge secret: %v", err)
+	}
+
+	srv := &Server{
+		db:                 db,
+		agh:                agh,
+		buildssrhtEndpoint: buildssrhtEndpoint,
+		srhtOAuth2Client:   srhtOAuth2Client,
+		ghOAuth2Client: &githubOAuth2Client{
+			ClientID:     ghClientID,
+			ClientSecret: ghClientSecret,
+		},
+		dedupWindow: dedupWindow,
+		publicURL:   strings.TrimSuffix(publicURL, "/"),
+		tpl:         tpl,
+		badgeSecret: badgeSecret,
+		admins:      parseAdmins(admins),
+		github:      newGitHubCache(atr),
+	}
+	queue := newWebhookQueue(db, webhookWorkers, srv.handleDelivery)
+
+	mux := chi.NewRouter()
+	mux.Use(forwardedHeaderMiddleware)
+	mux.Use(middleware.Logger)
+	mux.Use(middleware.Recoverer)
 
-	r := chi.NewRouter()
-	r.Use(forwardedHeaderMiddleware)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
+	// Exports of large DBs can take longer than the timeout below
+	mux.Get("/admin/export", srv.handleAdminExport)
 
-	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir(StaticDir))))
+	r := mux.With(middleware.Timeout(60 * time.Second))
+
+	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		data := struct {
@@ -112,13 +193,38 @@ func main() {
 		}{
 			App: app,
 		}
-		if err := tpl.ExecuteTemplate(w, "index.html", &data); err != nil {
-			panic(err)
-		}
+		srv.renderTemplate(w, "index.html", &data)
 	})
 
+	r.Get("/login", srv.handleLogin)
+	r.Get("/authorize-github", srv.handleAuthorizeGitHub)
+	r.Post("/logout", srv.handleLogout)
+	r.Get("/dashboard", srv.handleDashboard)
+	r.HandleFunc("/admin", srv.handleAdmin)
+	r.Route("/api/v1", srv.apiRoutes)
+	r.Get("/{owner}/{repo}", srv.handleRepoHistory)
+	r.Get("/{owner}/{repo}/builds.atom", srv.handleRepoFeed)
+	r.Get("/{owner}/{repo}/jobs/{id}", srv.handleJobPage)
+	r.Get("/{owner}/{repo}/jobs/{id}/log", srv.handleJobLogStream)
+	r.HandleFunc("/{owner}/{repo}/settings", srv.handleRepoSettings)
+	r.Get("/badge/{owner}/{repo}", srv.handleBadge)
+
 	r.HandleFunc("/authorize-srht", func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
+
+		// The state must match the one saved when redirecting the user to
+		// sr.ht, otherwise a user could be tricked into linking the sr.ht
+		// account of someone else
+		cookie, err := r.Cookie(srhtStateCookieName)
+		if err != nil {
+			http.Error(w, "missing OAuth2 state cookie", http.StatusBadRequest)
+			return
+		} else if cookie.Value == "" || cookie.Value != q.Get("state") {
+			http.Error(w, "invalid OAuth2 state", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: srhtStateCookieName, Path: "/", MaxAge: -1})
+
 		state, _ := url.ParseQuery(q.Get("state"))
 		id, err := strconv.ParseInt(state.Get("installation_id"), 10, 64)
 		if err != nil {
@@ -145,6 +251,19 @@ func main() {
 		}
 
 		ctx := r.Context()
+		session := srv.requireSession(w, r)
+		if session == nil {
+			return
+		}
+		if ok, err := canManageInstallation(ctx, session.GitHub(), session.GitHubLogin, installation); err != nil {
+			log.Printf("failed to check permissions for installation %v: %v", id, err)
+			http.Error(w, "failed to check permissions", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "only the user who installed the app or an organization admin can link a sr.ht account", http.StatusForbidden)
+			return
+		}
+
 		tokenResp, err := srhtOAuth2Client.Exchange(ctx, code)
 		if err == nil && tokenResp.TokenType != oauth2.TokenTypeBearer {
 			err = fmt.Errorf("unsupported OAuth2 token type %q", tokenResp.TokenType)
@@ -155,7 +274,13 @@ func main() {
 			return
 		}
 
-		if err := saveSrhtToken(ctx, db, buildssrhtEndpoint, srhtOAuth2Client, installation, tokenResp); err != nil {
+		mapping := parseSrhtMapping(state.Get("srht_mapping"))
+		var relink *string
+		if state.Has("relink") {
+			username := state.Get("relink")
+			relink = &username
+		}
+		if err := saveSrhtToken(ctx, db, buildssrhtEndpoint, srhtOAuth2Client, installation, tokenResp, mapping, relink); err != nil {
 			log.Print(err)
 			http.Error(w, "invalid sr.ht token", http.StatusInternalServerError)
 			return
@@ -179,18 +304,68 @@ func main() {
 			return
 		}
 
-		if token := r.FormValue("srht_token"); installation != nil && token != "" && installation.SrhtToken == "" {
-			// TODO: a sr.ht user could potentially "steal" a GitHub
-			// installation belonging to someone else, by guessing the
-			// installation ID before the user has the chance to submit the
-			// sr.ht token
+		// Changes are only accepted from forms submitted on this page
+		var mapping []string
+		var relink *string
+		var token string
+		if r.Method == http.MethodPost {
+			if !checkCSRFToken(r) {
+				http.Error(w, "invalid CSRF token", http.StatusForbidden)
+				return
+			}
+
+			// Additional sr.ht accounts can be linked for a subset of the
+			// repositories
+			mapping = parseSrhtMapping(r.PostFormValue("srht_mapping"))
+
+			// An already linked sr.ht account can be linked again to
+			// replace its token, e.g. to add grants
+			if r.PostForm.Has("relink") {
+				username := r.PostForm.Get("relink")
+				relink = &username
+			}
+
+			token = r.PostFormValue("srht_token")
+		}
+
+		linkAccount := installation != nil && (installation.SrhtToken == "" || installation.SrhtNeedsReauth || len(mapping) > 0 || relink != nil)
+
+		// Only the user who installed the app and organization admins can
+		// link sr.ht accounts, otherwise anyone guessing the installation ID
+		// could attach their own account
+		canManage := false
+		if installation != nil {
+			session, err := srv.getSession(r)
+			if err != nil {
+				log.Printf("failed to get session: %v", err)
+				http.Error(w, "failed to get session", http.StatusInternalServerError)
+				return
+			}
+
+			if session == nil && linkAccount {
+				srv.requireSession(w, r)
+				return
+			} else if session != nil {
+				canManage, err = canManageInstallation(r.Context(), session.GitHub(), session.GitHubLogin, installation)
+				if err != nil {
+					log.Printf("failed to check permissions for installation %v: %v", id, err)
+					http.Error(w, "failed to check permissions", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if linkAccount && !canManage {
+				http.Error(w, "only the user who installed the app or an organization admin can link a sr.ht account", http.StatusForbidden)
+				return
+			}
+		}
 
-			// TODO: discover sr.ht token scope somehow
+		if linkAccount && token != "" {
 			tokenResp := &oauth2.TokenResp{
 				AccessToken: token,
 				TokenType:   oauth2.TokenTypeBearer,
 			}
-			if err := saveSrhtToken(r.Context(), db, buildssrhtEndpoint, srhtOAuth2Client, installation, tokenResp); err != nil {
+			if err := saveSrhtToken(r.Context(), db, buildssrhtEndpoint, srhtOAuth2Client, installation, tokenResp, mapping, relink); err != nil {
 				log.Print(err)
 				http.Error(w, "invalid sr.ht token", http.StatusBadRequest)
 				return
@@ -198,7 +373,7 @@ func main() {
 		}
 
 		var scopes string
-		if r.URL.Query().Get("state") == "enable_secrets" {
+		if r.URL.Query().Get("state") == "enable_secrets" || r.PostFormValue("enable_secrets") != "" {
 			scopes = srhtGrants + " " + srhtGrantsSecrets
 		} else {
 			scopes = srhtGrants
@@ -206,20 +381,45 @@ func main() {
 
 		// If we have a sr.ht client setup, redirect to the sr.ht authorization
 		// page
-		if installation != nil && installation.SrhtToken == "" && srhtClientID != "" {
+		if linkAccount && token == "" && srhtClientID != "" && (installation.SrhtToken == "" || installation.SrhtNeedsReauth || r.Method == http.MethodPost) {
 			state := make(url.Values)
 			state.Set("installation_id", strconv.FormatInt(id, 10))
+			if len(mapping) > 0 {
+				state.Set("srht_mapping", strings.Join(mapping, " "))
+			}
+			if relink != nil {
+				state.Set("relink", *relink)
+			}
+			nonce, err := generateToken()
+			if err != nil {
+				log.Printf("failed to generate OAuth2 state: %v", err)
+				http.Error(w, "failed to generate OAuth2 state", http.StatusInternalServerError)
+				return
+			}
+			state.Set("nonce", nonce)
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     srhtStateCookieName,
+				Value:    state.Encode(),
+				Path:     "/",
+				MaxAge:   int((10 * time.Minute).Seconds()),
+				HttpOnly: true,
+				Secure:   isSecureRequest(r),
+				SameSite: http.SameSiteLaxMode,
+			})
 
 			redirectURL := srhtOAuth2Client.AuthorizationCodeURL(&oauth2.AuthorizationOptions{
 				State: state.Encode(),
 				Scope: strings.Split(scopes, " "),
 			})
-			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+			http.Redirect(w, r, redirectURL, http.StatusFound)
 			return
 		}
 
 		var installSettingsURL string
+		var srhtAccounts []srhtAccountStatus
 		if installation != nil {
+			srhtAccounts = listSrhtAccounts(installation)
 			if installation.Org != "" {
 				installSettingsURL = fmt.Sprintf("https://github.com/organizations/%v/settings/installations/%v", installation.Org, id)
 			} else {
@@ -230,17 +430,29 @@ func main() {
 		data := struct {
 			Pending            bool
 			Done               bool
+			Reauth             bool
 			SrhtGrants         string
 			InstallSettingsURL string
+			Installation       *Installation
+			SrhtAccounts       []srhtAccountStatus
+			SrhtOAuth2         bool
+			CanManage          bool
+			LoginURL           string
+			CSRFToken          string
 		}{
 			Pending:            installation == nil,
-			Done:               installation != nil && installation.SrhtToken != "",
+			Done:               installation != nil && installation.SrhtToken != "" && !installation.SrhtNeedsReauth,
+			Reauth:             installation != nil && installation.SrhtNeedsReauth,
 			SrhtGrants:         scopes,
 			InstallSettingsURL: installSettingsURL,
+			Installation:       installation,
+			SrhtAccounts:       srhtAccounts,
+			SrhtOAuth2:         srhtClientID != "",
+			CanManage:          canManage,
+			LoginURL:           "/login?" + url.Values{"redirect": {r.URL.RequestURI()}}.Encode(),
+			CSRFToken:          csrfToken(r),
 		}
-		if err := tpl.ExecuteTemplate(w, "post-install.html", &data); err != nil {
-			panic(err)
-		}
+		srv.renderTemplate(w, "post-install.html", &data)
 	})
 
 	r.Post("/webhook", func(w http.ResponseWriter, r *http.Request) {
@@ -251,121 +463,48 @@ func main() {
 			return
 		}
 
-		event, err := github.ParseWebHook(github.WebHookType(r), payload)
-		if err != nil {
+		// Check that the payload can be parsed before enqueuing it
+		if _, err := github.ParseWebHook(github.WebHookType(r), payload); err != nil {
 			log.Printf("failed to parse webhook payload: %v", err)
 			http.Error(w, "failed to parse webhook paload", http.StatusBadRequest)
 			return
 		}
 
-		switch event := event.(type) {
-		case *github.PingEvent:
-			log.Printf("received ping (%v)", *event.Zen)
-		case *github.InstallationEvent:
-			log.Printf("installation %v by %v", event.GetAction(), event.Sender.GetLogin())
-			switch event.GetAction() {
-			case "created":
-				owner := event.Sender.GetLogin()
-				org := event.Installation.GetAccount().GetLogin()
-				if org == owner {
-					org = ""
-				}
-				err = db.StoreInstallation(&Installation{
-					ID:        *event.Installation.ID,
-					CreatedAt: time.Now(),
-					Owner:     owner,
-					Org:       org,
-				})
-			case "deleted":
-				err = db.DeleteInstallation(*event.Installation.ID)
-			}
-		case *github.InstallationRepositoriesEvent:
-			log.Printf("installation repositories %v by %v (%v added, %v removed)", event.GetAction(), event.Sender.GetLogin(), len(event.RepositoriesAdded), len(event.RepositoriesRemoved))
-		case *github.CheckSuiteEvent:
-			if *event.Action != "requested" && *event.Action != "rerequested" {
-				break
-			}
-
-			var installation *Installation
-			installation, err = db.GetInstallation(*event.Installation.ID)
-			if err != nil {
-				break
-			}
-
-			if err := refreshSrhtToken(r.Context(), db, srhtOAuth2Client, installation); err != nil {
-				log.Printf("failed to refresh sr.ht token for installation %v: %v", installation.ID, err)
-			}
-
-			ctx := &checkSuiteContext{
-				Context:        r.Context(),
-				gh:             newInstallationClient(atr, event.Installation),
-				srht:           createSrhtClient(buildssrhtEndpoint, srhtOAuth2Client, installation),
-				baseRepo:       event.Repo,
-				headRepo:       event.Repo,
-				headCommit:     event.CheckSuite.HeadCommit,
-				headSHA:        event.CheckSuite.GetHeadSHA(),
-				ownerSubmitted: event.Sender.GetLogin() == installation.Owner,
-			}
-			if len(event.CheckSuite.PullRequests) == 1 {
-				ctx.pullRequest = event.CheckSuite.PullRequests[0]
-			} else if len(event.CheckSuite.PullRequests) == 0 && event.CheckSuite.HeadBranch != nil {
-				ctx.headBranch = *event.CheckSuite.HeadBranch
-			}
-			err = startCheckSuite(ctx)
-		case *github.CheckRunEvent:
-			// ignore
-		case *github.PullRequestEvent:
-			// GitHub doesn't automatically create a CheckSuiteEvent for pull
-			// requests made from a fork, so we need to manually handle this
-			// case:
-			// https://github.community/t/no-check-suite-event-for-foreign-pull-reuqests/13915/2
-			if *event.Action != "opened" && *event.Action != "reopened" && *event.Action != "synchronize" {
-				break
-			}
-			if event.PullRequest.Head.Repo.GetFullName() == event.PullRequest.Base.Repo.GetFullName() {
-				break
-			}
-
-			var installation *Installation
-			installation, err = db.GetInstallation(*event.Installation.ID)
-			if err != nil {
-				break
-			}
-
-			ctx := &checkSuiteContext{
-				Context:        r.Context(),
-				gh:             newInstallationClient(atr, event.Installation),
-				srht:           createSrhtClient(buildssrhtEndpoint, srhtOAuth2Client, installation),
-				baseRepo:       event.Repo,
-				headRepo:       event.PullRequest.Head.Repo,
-				headSHA:        event.PullRequest.Head.GetSHA(),
-				pullRequest:    event.PullRequest,
-				ownerSubmitted: event.Sender.GetLogin() == installation.Owner,
-			}
-
-			var repoCommit *github.RepositoryCommit
-			repoCommit, _, err = ctx.gh.Repositories.GetCommit(ctx, ctx.headRepo.Owner.GetLogin(), ctx.headRepo.GetName(), ctx.headSHA, nil)
-			if err != nil {
-				break
-			}
-			ctx.headCommit = repoCommit.Commit
-
-			err = startCheckSuite(ctx)
-		default:
-			log.Printf("unhandled event type: %T", event)
+		err = queue.Enqueue(&Delivery{
+			GUID:       github.DeliveryID(r),
+			Event:      github.WebHookType(r),
+			Payload:    payload,
+			ReceivedAt: time.Now(),
+		})
+		if err == ErrDuplicate {
+			log.Printf("ignoring duplicate webhook delivery %v", github.DeliveryID(r))
+			return
+		} else if err != nil {
+			log.Printf("failed to enqueue webhook delivery: %v", err)
+			http.Error(w, "failed to enqueue webhook delivery", http.StatusInternalServerError)
+			return
 		}
 
-		if err != nil {
-			log.Printf("failed to handle event %T: %v", event, err)
-			http.Error(w, "failed to handle event", http.StatusInternalServerError)
-		}
+		w.WriteHeader(http.StatusAccepted)
 	})
 
-	server := &http.Server{Addr: addr, Handler: r}
+	httpServer := &http.Server{Addr: addr, Handler: mux}
 
 	var cancelMonitor context.CancelFunc
 	monitorContext, cancelMonitor = context.WithCancel(context.Background())
 
+	queueCtx, cancelQueue := context.WithCancel(context.Background())
+	queueDone := make(chan struct{})
+	go func() {
+		queue.Run(queueCtx)
+		close(queueDone)
+	}()
+	go pruneDBPeriodically(queueCtx, db, dedupWindow)
+	go refreshSrhtTokensPeriodically(queueCtx, db, srhtOAuth2Client)
+	if recoveryInterval > 0 {
+		go recoverDeliveriesPeriodically(queueCtx, db, agh, recoveryInterval)
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -374,20 +513,56 @@ func main() {
 		cancelMonitor()
 
 		log.Printf("Shutting down server")
-		if err := server.Shutdown(context.Background()); err != nil {
+		if err := httpServer.Shutdown(context.Background()); err != nil {
 			log.Fatalf("failed to shutdown server: %v", err)
 		}
 
 		// By this point, no more incoming HTTP requests are handled
+		cancelQueue()
+		<-queueDone
 		monitorWaitGroup.Wait()
 	}()
 
 	log.Printf("Server listening on %v", addr)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("failed to listen and serve: %v", err)
 	}
 }
 
+// Server holds the state shared by HTTP handlers and background workers.
+type Server struct {
+	db                 *DB
+	agh                *github.Client
+	buildssrhtEndpoint string
+	srhtOAuth2Client   *oauth2.Client
+	ghOAuth2Client     *githubOAuth2Client
+	dedupWindow        time.Duration
+	publicURL          string
+	tpl                *template.Template
+	badgeSecret        []byte
+	admins             map[string]bool // lower-case GitHub logins
+	github             *githubCache
+}
+
+// relinkURL returns the URL of the page to link sr.ht accounts to an
+// installation again.
+func (srv *Server) relinkURL(installation *Installation) string {
+	return fmt.Sprintf("%v/post-install?installation_id=%v", srv.publicURL, installation.ID)
+}
+
+// reauthError indicates that a sr.ht account linked to an installation can't
+// be used anymore, and needs to be linked again.
+type reauthError struct {
+	username string
+}
+
+func (err reauthError) Error() string {
+	if err.username == "" {
+		return "sr.ht token expired or revoked, the account needs to be linked again"
+	}
+	return fmt.Sprintf("sr.ht token of %v expired or revoked, the account needs to be linked again", err.username)
+}
+
 // userError is a configuration error on the user's end.
 type userError struct {
 	error
@@ -395,15 +570,33 @@ type userError struct {
 
 type checkSuiteContext struct {
 	context.Context
+	srv                *Server
 	gh                 *github.Client
 	srht               *SrhtClient
+	installation       *Installation
+	settings           *RepoSettings
 	baseRepo, headRepo *github.Repository
 	headSHA            string
 	headCommit         *github.Commit
+	sender             string // GitHub login
 	ownerSubmitted     bool
 
 	pullRequest *github.PullRequest // may be nil
 	headBranch  string              // may be empty
+	mergeGroup  *github.MergeGroup  // may be nil
+
+	forceBuild bool   // don't re-use recently submitted jobs
+	jobs       []*Job // jobs submitted for the check suite
+	failure    error  // user error reported as a failed status, if any
+}
+
+func (ctx *checkSuiteContext) fetchHeadCommit() error {
+	repoCommit, _, err := ctx.gh.Repositories.GetCommit(ctx, ctx.headRepo.Owner.GetLogin(), ctx.headRepo.GetName(), ctx.headSHA, nil)
+	if err != nil {
+		return err
+	}
+	ctx.headCommit = repoCommit.Commit
+	return nil
 }
 
 func startCheckSuite(ctx *checkSuiteContext) (err error) {
@@ -413,8 +606,16 @@ func startCheckSuite(ctx *checkSuiteContext) (err error) {
 		}
 
 		msg := "internal error"
+		var targetURL string
+		var reauthErr reauthError
 		if userErr, ok := err.(userError); ok {
 			msg = userErr.Error()
+			ctx.failure = err
+			err = nil
+		} else if errors.As(err, &reauthErr) {
+			msg = reauthErr.Error()
+			targetURL = ctx.srv.relinkURL(ctx.installation)
+			ctx.failure = err
 			err = nil
 		}
 
@@ -425,25 +626,29 @@ func startCheckSuite(ctx *checkSuiteContext) (err error) {
 		defer cancel()
 		failCtx.Context = failBareCtx
 
-		statusContext := "builds.sr.ht"
-		repoStatus := &github.RepoStatus{Context: &statusContext}
+		repoStatus := &commitStatus{Context: ctx.settings.statusContext(), TargetURL: targetURL}
 		statusErr := updateRepoStatus(&failCtx, repoStatus, "failure", msg)
 		if statusErr != nil {
 			log.Printf("failed to create commit status: %v", statusErr)
 		}
 	}()
 
+	// Don't submit jobs until the sr.ht account is linked again
+	if ctx.srht.Credentials.SrhtNeedsReauth {
+		return reauthError{ctx.srht.Credentials.SrhtUsername}
+	}
+
 	filenames, err := listManifestCandidates(ctx, ctx.gh, ctx.headRepo.Owner.GetLogin(), ctx.headRepo.GetName(), ctx.headSHA)
 	if err != nil {
 		return err
 	}
 
 	// Select a few manifests at random if there are too many
-	if len(filenames) > maxJobsPerCheckSuite {
+	if limit := ctx.settings.jobLimit(); len(filenames) > limit {
 		rand.Shuffle(len(filenames), func(i, j int) {
 			filenames[i], filenames[j] = filenames[j], filenames[i]
 		})
-		filenames = filenames[:maxJobsPerCheckSuite]
+		filenames = filenames[:limit]
 	}
 
 	for _, filename := range filenames {
@@ -455,12 +660,18 @@ func startCheckSuite(ctx *checkSuiteContext) (err error) {
 	return nil
 }
 
-func startJob(ctx *checkSuiteContext, filename string) error {
-	basename := path.Base(filename)
-	name := strings.TrimSuffix(basename, path.Ext(basename))
+// manifestName returns the name of a build manifest, used to name statuses
+// and tag jobs. The name is empty for the main manifest.
+func manifestName(filename string) string {
 	if filename == ".build.yml" {
-		name = ""
+		return ""
 	}
+	basename := path.Base(filename)
+	return strings.TrimSuffix(basename, path.Ext(basename))
+}
+
+func startJob(ctx *checkSuiteContext, filename string) error {
+	name := manifestName(filename)
 
 	manifest, err := fetchManifest(ctx, ctx.gh, ctx.headRepo.Owner.GetLogin(), ctx.headRepo.GetName(), ctx.headSHA, filename)
 	if err != nil {
@@ -512,6 +723,11 @@ func startJob(ctx *checkSuiteContext, filename string) error {
 	if !ok {
 		return userError{fmt.Errorf("invalid manifest: `environment` is not a map with string keys")}
 	}
+	for k, v := range ctx.settings.Env {
+		if _, ok := env[k]; !ok {
+			env[k] = v
+		}
+	}
 	env["BUILD_SUBMITTER"] = "hottub"
 
 	manifestBuf, err := yaml.Marshal(manifest)
@@ -522,6 +738,8 @@ func startJob(ctx *checkSuiteContext, filename string) error {
 	tags := []string{ctx.baseRepo.GetName()}
 	if ctx.pullRequest != nil {
 		tags = append(tags, "pulls", fmt.Sprintf("%v", ctx.pullRequest.GetNumber()))
+	} else if ctx.mergeGroup != nil {
+		tags = append(tags, "merge-queue")
 	} else if ctx.headBranch != "" {
 		tags = append(tags, "commits", ctx.headBranch)
 	}
@@ -530,8 +748,10 @@ func startJob(ctx *checkSuiteContext, filename string) error {
 	}
 
 	visibility := buildssrht.VisibilityPublic
-	if *ctx.headRepo.Private {
+	if ctx.baseRepo.GetPrivate() || ctx.headRepo.GetPrivate() {
 		visibility = buildssrht.VisibilityPrivate
+	} else if ctx.settings.Visibility != "" {
+		visibility = ctx.settings.Visibility
 	}
 
 	commit := ctx.headCommit
@@ -544,60 +764,241 @@ func startJob(ctx *checkSuiteContext, filename string) error {
 
 [%v]: %v`, title, shortHash, commit.Author.GetName(), shortHash, commitURL)
 
-	// Use automatic secrets (nil) if the account owner submitted the job
+	// Use automatic secrets (nil) if allowed by the repository settings
+	var allowSecrets bool
+	switch ctx.settings.secretsPolicy() {
+	case SecretsPolicyOwner:
+		allowSecrets = ctx.ownerSubmitted
+	case SecretsPolicySameRepo:
+		allowSecrets = ctx.headRepo.GetID() == ctx.baseRepo.GetID()
+	}
 	var includeSecrets *bool = nil
-	if !ctx.ownerSubmitted {
+	if !allowSecrets {
 		falseValue := false
 		includeSecrets = &falseValue
 	}
 
-	job, err := buildssrht.SubmitJob(ctx.srht.GQL, ctx, string(manifestBuf), tags, &note, includeSecrets, visibility)
-	if err != nil {
-		var httpErr *gqlclient.HTTPError
-		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusForbidden {
-			return userError{fmt.Errorf("failed to submit sr.ht job: %v", err)}
-		} else {
-			return fmt.Errorf("failed to submit sr.ht job: %v", err)
+	// Re-use a job submitted recently for the same manifest, e.g. when
+	// multiple check suites are created for the same commit
+	var build *Build
+	key := buildKey(ctx.baseRepo.GetFullName(), ctx.headSHA, filename, manifestBuf)
+	if ctx.srv.dedupWindow > 0 && !ctx.forceBuild {
+		build, err = ctx.srv.db.GetRecentBuild(key, ctx.srv.dedupWindow)
+		if err != nil && err != ErrNotFound {
+			return fmt.Errorf("failed to get build: %v", err)
+		}
+	}
+
+	reused := build != nil
+	if reused {
+		log.Printf("re-using sr.ht job #%v for %v", build.JobID, filename)
+	} else {
+		job, err := buildssrht.SubmitJob(ctx.srht.GQL, ctx, string(manifestBuf), tags, &note, includeSecrets, visibility)
+		if err != nil {
+			if missing := ctx.srht.Credentials.MissingGrants(srhtGrants); len(missing) > 0 && isSrhtAccessDenied(err) {
+				return userError{fmt.Errorf("failed to submit sr.ht job: token of %v is missing the %v grant", ctx.srht.Credentials.SrhtUsername, strings.Join(missing, " "))}
+			} else if isSrhtAuthFailure(err) {
+				if err := markSrhtNeedsReauth(ctx.srv.db, ctx.installation.ID, ctx.srht.Credentials); err != nil {
+					log.Print(err)
+				}
+				return reauthError{ctx.srht.Credentials.SrhtUsername}
+			} else if isSrhtForbidden(err) {
+				return userError{fmt.Errorf("failed to submit sr.ht job: access denied for %v", ctx.srht.Credentials.SrhtUsername)}
+			} else {
+				return fmt.Errorf("failed to submit sr.ht job: %v", err)
+			}
+		}
+
+		build = &Build{
+			JobID:       job.Id,
+			DetailsURL:  fmt.Sprintf("%v/%v/job/%v", ctx.srht.Endpoint, job.Owner.CanonicalName, job.Id),
+			SubmittedAt: time.Now(),
+		}
+		if err := ctx.srv.db.StoreBuild(key, build); err != nil {
+			log.Printf("failed to store build for sr.ht job #%v: %v", job.Id, err)
 		}
 	}
 
-	detailsURL := fmt.Sprintf("%v/%v/job/%v", ctx.srht.Endpoint, job.Owner.CanonicalName, job.Id)
-	statusContext := "builds.sr.ht"
+	statusContext := ctx.settings.statusContext()
 	if name != "" {
 		statusContext += "/" + name
 	}
-	repoStatus := &github.RepoStatus{TargetURL: &detailsURL, Context: &statusContext}
+
+	record := &Job{
+		ID:             build.JobID,
+		InstallationID: ctx.installation.ID,
+		Repo:           ctx.baseRepo.GetFullName(),
+		Commit:         ctx.headSHA,
+		Title:          title,
+		Branch:         ctx.headBranch,
+		MergeGroup:     ctx.mergeGroup != nil,
+		Manifest:       filename,
+		DetailsURL:     build.DetailsURL,
+		Submitter:      ctx.sender,
+		SrhtUsername:   ctx.srht.Credentials.SrhtUsername,
+		Secrets:        includeSecrets == nil,
+		Visibility:     visibility,
+		StatusContext:  statusContext,
+		Status:         string(buildssrht.JobStatusPending),
+		SubmittedAt:    build.SubmittedAt,
+	}
+	if ctx.pullRequest != nil {
+		record.PullRequest = ctx.pullRequest.GetNumber()
+	}
+	if reused {
+		err = ctx.srv.db.StoreReusedJob(record)
+	} else {
+		err = ctx.srv.db.StoreJob(record)
+	}
+	if err != nil {
+		log.Printf("failed to store history for sr.ht job #%v: %v", build.JobID, err)
+	}
+	ctx.jobs = append(ctx.jobs, record)
+
+	// Link to the hottub job page, so that contributors without access to
+	// private sr.ht jobs can see the logs
+	targetURL := ctx.srv.jobPageURL(ctx.baseRepo.GetFullName(), build.JobID)
+	repoStatus := &commitStatus{TargetURL: targetURL, Context: statusContext}
 	err = updateRepoStatus(ctx, repoStatus, "pending", "build started…")
 	if err != nil {
 		return fmt.Errorf("failed to create commit status: %v", err)
 	}
+	// Remember the check run, so that monitoring can be resumed later on
+	if repoStatus.checkRunID != 0 {
+		err := ctx.srv.db.UpdateJob(build.JobID, func(job *Job) {
+			job.StatusContext = statusContext
+			job.CheckRunID = repoStatus.checkRunID
+		})
+		if err != nil {
+			log.Printf("failed to store check run for sr.ht job #%v: %v", build.JobID, err)
+		}
+	}
+
+	active := &activeJob{
+		installationID: ctx.installation.ID,
+		id:             build.JobID,
+		srht:           ctx.srht,
+	}
+
+	// Jobs using secrets fail if the token can't access them
+	if _, ok := manifest["secrets"]; ok && !ctx.srht.Credentials.HasGrant(srhtGrantsSecrets) {
+		active.missingGrant = srhtGrantsSecrets
+	}
+
+	startMonitor(ctx, active, repoStatus)
+	return nil
+}
+
+// startMonitor starts monitoring a job in the background, reporting its status
+// to GitHub until it finishes.
+func startMonitor(ctx *checkSuiteContext, active *activeJob, repoStatus *commitStatus) {
+	jobCtx, cancel := context.WithCancel(monitorContext)
+	active.cancel = cancel
+	activeJobs.add(active)
 
 	monitorWaitGroup.Add(1)
 	go func() {
 		defer monitorWaitGroup.Done()
+		defer activeJobs.remove(active)
+		defer cancel()
 
 		childCtx := *ctx
-		childCtx.Context = monitorContext
+		childCtx.Context = jobCtx
 
-		if err := monitorJob(&childCtx, repoStatus, job.Id); err != nil {
-			log.Printf("failed to monitor sr.ht job #%d: %v", job.Id, err)
+		if err := monitorJob(&childCtx, active, repoStatus); err != nil {
+			if activeJobs.isCancelled(active) {
+				return
+			}
+
+			log.Printf("failed to monitor sr.ht job #%d: %v", active.id, err)
 
 			failBareCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
 			failCtx := childCtx
 			failCtx.Context = failBareCtx
 
-			updateRepoStatus(&failCtx, repoStatus, "failure", "internal error")
+			description := "internal error"
+			var reauthErr reauthError
+			if userErr, ok := err.(userError); ok {
+				description = userErr.Error()
+			} else if errors.As(err, &reauthErr) {
+				description = reauthErr.Error()
+				repoStatus.TargetURL = ctx.srv.relinkURL(ctx.installation)
+			}
+			updateRepoStatus(&failCtx, repoStatus, "failure", description)
 		}
 	}()
+}
 
+// resumeJobs resumes monitoring the unfinished jobs of an installation, e.g.
+// after monitoring has been stopped by cancelInstallation.
+func (srv *Server) resumeJobs(ctx context.Context, installationID int64) error {
+	installation, err := srv.db.GetInstallation(installationID)
+	if err != nil {
+		return fmt.Errorf("failed to get installation %v: %v", installationID, err)
+	} else if installation.Suspended || installation.Disabled {
+		return nil
+	}
+	jobs, err := srv.db.ListJobs(&JobQuery{InstallationID: installationID})
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	gh := srv.github.installationClient(installationID)
+	for _, job := range jobs {
+		if !job.FinishedAt.IsZero() || activeJobs.has(job.ID) {
+			continue
+		}
+		if job.StatusContext == "" {
+			log.Printf("cannot resume sr.ht job #%v: unknown status context", job.ID)
+			continue
+		}
+
+		owner, name, _ := strings.Cut(job.Repo, "/")
+		repo, err := srv.getInstalledRepo(ctx, owner, name)
+		if err != nil {
+			log.Printf("cannot resume sr.ht job #%v: %v", job.ID, err)
+			continue
+		}
+		srht, err := srv.jobSrhtClient(job)
+		if err != nil {
+			log.Printf("cannot resume sr.ht job #%v: %v", job.ID, err)
+			continue
+		}
+
+		suiteCtx := &checkSuiteContext{
+			Context:      ctx,
+			srv:          srv,
+			gh:           gh,
+			srht:         srht,
+			installation: installation,
+			baseRepo:     repo,
+			headSHA:      job.Commit,
+		}
+		repoStatus := &commitStatus{
+			Context:    job.StatusContext,
+			TargetURL:  srv.jobPageURL(job.Repo, job.ID),
+			checkRunID: job.CheckRunID,
+		}
+		active := &activeJob{
+			installationID: installationID,
+			id:             job.ID,
+			srht:           srht,
+		}
+		startMonitor(suiteCtx, active, repoStatus)
+		log.Printf("resumed monitoring of sr.ht job #%v", job.ID)
+	}
 	return nil
 }
 
-func monitorJob(ctx *checkSuiteContext, repoStatus *github.RepoStatus, jobID int32) error {
+func monitorJob(ctx *checkSuiteContext, active *activeJob, repoStatus *commitStatus) error {
+	jobID := active.id
 	prevStatus := buildssrht.JobStatusPending
 	for {
 		time.Sleep(monitorJobInterval)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		var (
 			job *buildssrht.Job
@@ -605,7 +1006,14 @@ func monitorJob(ctx *checkSuiteContext, repoStatus *github.RepoStatus, jobID int
 		)
 		for i := 0; job == nil && i < monitorMaxRetries; i++ {
 			job, err = buildssrht.FetchJob(ctx.srht.GQL, ctx, jobID)
-			if err != nil {
+			if isSrhtAuthFailure(err) {
+				if err := markSrhtNeedsReauth(ctx.srv.db, ctx.installation.ID, ctx.srht.Credentials); err != nil {
+					log.Print(err)
+				}
+				return reauthError{ctx.srht.Credentials.SrhtUsername}
+			} else if isSrhtForbidden(err) {
+				return userError{fmt.Errorf("failed to fetch sr.ht job: access denied for %v", ctx.srht.Credentials.SrhtUsername)}
+			} else if err != nil {
 				log.Printf("failed to fetch sr.ht job #%v (try %v/%v): %v", jobID, i+1, monitorMaxRetries, err)
 				job = nil
 				time.Sleep(monitorJobInterval)
@@ -618,14 +1026,25 @@ func monitorJob(ctx *checkSuiteContext, repoStatus *github.RepoStatus, jobID int
 		if job.Status == prevStatus {
 			continue
 		}
+		prevStatus = job.Status
+		activeJobs.setStatus(active, job.Status)
+
+		finished := true
+		switch job.Status {
+		case buildssrht.JobStatusPending, buildssrht.JobStatusQueued, buildssrht.JobStatusRunning:
+			finished = false
+		}
+		if err := ctx.srv.db.UpdateJobStatus(jobID, string(job.Status), finished); err != nil && err != ErrNotFound {
+			log.Printf("failed to update history for sr.ht job #%v: %v", jobID, err)
+		}
 
 		state, description := jobStatusToGitHub(job.Status)
+		if state != "pending" && state != "success" && active.missingGrant != "" {
+			description += fmt.Sprintf(" (sr.ht token is missing the %v grant)", active.missingGrant)
+		}
 		updateRepoStatus(ctx, repoStatus, state, description)
 
-		switch job.Status {
-		case buildssrht.JobStatusPending, buildssrht.JobStatusQueued, buildssrht.JobStatusRunning:
-			// Continue
-		default:
+		if finished {
 			return nil
 		}
 	}
@@ -652,18 +1071,83 @@ func jobStatusToGitHub(jobStatus buildssrht.JobStatus) (state, description strin
 	}
 }
 
-func updateRepoStatus(ctx *checkSuiteContext, repoStatus *github.RepoStatus, state, description string) error {
+// commitStatus is a status reported to GitHub for the head commit. It's
+// either reported as a commit status or as a check run, depending on the
+// permissions granted to the installation.
+type commitStatus struct {
+	Context   string
+	TargetURL string // may be empty
+
+	checkRunID int64
+}
+
+func updateRepoStatus(ctx *checkSuiteContext, repoStatus *commitStatus, state, description string) error {
 	// GitHub rejects updates when description exceeds 140 characters
 	if len(description) > 140 {
 		description = description[:140]
 	}
-	repoStatus = &github.RepoStatus{
-		TargetURL:   repoStatus.TargetURL,
-		Context:     repoStatus.Context,
+
+	if ctx.installation != nil && ctx.installation.UseChecks() {
+		return updateCheckRun(ctx, repoStatus, state, description)
+	}
+
+	status := &github.RepoStatus{
+		Context:     &repoStatus.Context,
 		State:       &state,
 		Description: &description,
 	}
-	_, _, err := ctx.gh.Repositories.CreateStatus(ctx, ctx.baseRepo.Owner.GetLogin(), ctx.baseRepo.GetName(), ctx.headSHA, repoStatus)
+	if repoStatus.TargetURL != "" {
+		status.TargetURL = &repoStatus.TargetURL
+	}
+	_, _, err := ctx.gh.Repositories.CreateStatus(ctx, ctx.baseRepo.Owner.GetLogin(), ctx.baseRepo.GetName(), ctx.headSHA, status)
+	return err
+}
+
+func updateCheckRun(ctx *checkSuiteContext, repoStatus *commitStatus, state, description string) error {
+	status := "completed"
+	var conclusion *string
+	switch state {
+	case "pending":
+		status = "in_progress"
+	case "success":
+		conclusion = github.String("success")
+	default:
+		conclusion = github.String("failure")
+	}
+
+	var detailsURL *string
+	if repoStatus.TargetURL != "" {
+		detailsURL = &repoStatus.TargetURL
+	}
+	output := &github.CheckRunOutput{
+		Title:   &description,
+		Summary: &description,
+	}
+
+	owner, repo := ctx.baseRepo.Owner.GetLogin(), ctx.baseRepo.GetName()
+	if repoStatus.checkRunID == 0 {
+		checkRun, _, err := ctx.gh.Checks.CreateCheckRun(ctx, owner, repo, github.CreateCheckRunOptions{
+			Name:       repoStatus.Context,
+			HeadSHA:    ctx.headSHA,
+			DetailsURL: detailsURL,
+			Status:     &status,
+			Conclusion: conclusion,
+			Output:     output,
+		})
+		if err != nil {
+			return err
+		}
+		repoStatus.checkRunID = checkRun.GetID()
+		return nil
+	}
+
+	_, _, err := ctx.gh.Checks.UpdateCheckRun(ctx, owner, repo, repoStatus.checkRunID, github.UpdateCheckRunOptions{
+		Name:       repoStatus.Context,
+		DetailsURL: detailsURL,
+		Status:     &status,
+		Conclusion: conclusion,
+		Output:     output,
+	})
 	return err
 }
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+const schemaVersionKey = "schema_version"
+
+// migrations upgrade the DB schema: migrations[i] upgrades the DB from
+// version i to version i+1. Existing migrations must never be modified, new
+// ones must be appended.
+var migrations = []func(tx *bbolt.Tx) error{
+	// 1: create the initial buckets
+	func(tx *bbolt.Tx) error {
+		return createBuckets(tx, installationsBucket, metaBucket, webhookQueueBucket, webhookDeadBucket, deliveriesBucket, buildsBucket)
+	},
+	// 2: personal sr.ht tokens used to be stored with an expiration time set
+	// to the time they were linked
+	func(tx *bbolt.Tx) error {
+		b := tx.Bucket(installationsBucket)
+		updated := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(v, &raw); err != nil {
+				return err
+			}
+			if _, ok := raw["srht_refresh_token"]; ok {
+				return nil
+			}
+			if _, ok := raw["srht_token_expires_at"]; !ok {
+				return nil
+			}
+			delete(raw, "srht_token_expires_at")
+
+			b, err := json.Marshal(raw)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = b
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range updated {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 3: add GitHub login sessions
+	func(tx *bbolt.Tx) error {
+		return createBuckets(tx, sessionsBucket)
+	},
+	// 4: add the job history
+	func(tx *bbolt.Tx) error {
+		return createBuckets(tx, jobsBucket, jobIndexBucket)
+	},
+	// 5: add per-repository settings
+	func(tx *bbolt.Tx) error {
+		return createBuckets(tx, repoSettingsBucket)
+	},
+}
+
+// migrateDB upgrades the DB schema to the latest version. It fails if the DB
+// has been created by a more recent version of hottub.
+func migrateDB(db *bbolt.DB) (from, to int, err error) {
+	err = db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		from, err = getSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		to = len(migrations)
+		if from > to {
+			return fmt.Errorf("database schema version %v is newer than the latest supported version %v", from, to)
+		}
+
+		for i := from; i < to; i++ {
+			if err := migrations[i](tx); err != nil {
+				return fmt.Errorf("migration to schema version %v failed: %v", i+1, err)
+			}
+		}
+		if from == to {
+			return nil
+		}
+
+		b, err := json.Marshal(to)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put([]byte(schemaVersionKey), b)
+	})
+	return from, to, err
+}
+
+func getSchemaVersion(tx *bbolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0, nil
+	}
+	b := meta.Get([]byte(schemaVersionKey))
+	if b == nil {
+		return 0, nil
+	}
+
+	var version int
+	if err := json.Unmarshal(b, &version); err != nil {
+		return 0, fmt.Errorf("invalid schema version: %v", err)
+	}
+	return version, nil
+}
+
+func createBuckets(tx *bbolt.Tx, names ...[]byte) error {
+	for _, name := range names {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
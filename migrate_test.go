@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func openTestDB(t *testing.T) *bbolt.DB {
+	t.Helper()
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "hottub.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// openMigratedTestDB opens a DB with an up-to-date schema.
+func openMigratedTestDB(t *testing.T, kr *keyring) *DB {
+	t.Helper()
+	db := openTestDB(t)
+	if _, _, err := migrateDB(db); err != nil {
+		t.Fatalf("migrateDB() = %v", err)
+	}
+	return &DB{DB: db, keyring: kr}
+}
+
+func setSchemaVersion(t *testing.T, db *bbolt.DB, version int) {
+	t.Helper()
+	err := db.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(version)
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(schemaVersionKey), b)
+	})
+	if err != nil {
+		t.Fatalf("failed to set schema version: %v", err)
+	}
+}
+
+func readSchemaVersion(t *testing.T, db *bbolt.DB) int {
+	t.Helper()
+	var version int
+	err := db.View(func(tx *bbolt.Tx) error {
+		var err error
+		version, err = getSchemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to get schema version: %v", err)
+	}
+	return version
+}
+
+func TestMigrateDB_fresh(t *testing.T) {
+	db := openTestDB(t)
+
+	from, to, err := migrateDB(db)
+	if err != nil {
+		t.Fatalf("migrateDB() = %v", err)
+	}
+	if from != 0 || to != len(migrations) {
+		t.Errorf("migrateDB() = %v, %v, want 0, %v", from, to, len(migrations))
+	}
+	if v := readSchemaVersion(t, db); v != len(migrations) {
+		t.Errorf("schema version = %v, want %v", v, len(migrations))
+	}
+
+	buckets := append([][]byte{deliveriesBucket, sessionsBucket, jobIndexBucket}, exportBuckets...)
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			if tx.Bucket(name) == nil {
+				t.Errorf("missing bucket %q", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateDB_idempotent(t *testing.T) {
+	db := openTestDB(t)
+
+	if _, _, err := migrateDB(db); err != nil {
+		t.Fatalf("migrateDB() = %v", err)
+	}
+	from, to, err := migrateDB(db)
+	if err != nil {
+		t.Fatalf("second migrateDB() = %v", err)
+	}
+	if from != len(migrations) || to != len(migrations) {
+		t.Errorf("second migrateDB() = %v, %v, want %v, %v", from, to, len(migrations), len(migrations))
+	}
+}
+
+func TestMigrateDB_newerVersion(t *testing.T) {
+	db := openTestDB(t)
+	setSchemaVersion(t, db, len(migrations)+1)
+
+	if _, _, err := migrateDB(db); err == nil {
+		t.Fatal("migrateDB() succeeded on a DB with a newer schema version")
+	}
+	if v := readSchemaVersion(t, db); v != len(migrations)+1 {
+		t.Errorf("schema version = %v, want %v", v, len(migrations)+1)
+	}
+}
+
+func TestMigrateDB_srhtTokenExpiry(t *testing.T) {
+	db := openTestDB(t)
+
+	installations := map[int64]string{
+		// Personal token: the bogus expiration time must be removed
+		1: `{"srht_token":"personal","srht_token_expires_at":"2023-01-01T00:00:00Z"}`,
+		// OAuth2 token: the expiration time must be kept
+		2: `{"srht_token":"oauth2","srht_refresh_token":"refresh","srht_token_expires_at":"2023-01-01T00:00:00Z"}`,
+		// No expiration time: left as is
+		3: `{"srht_token":"personal"}`,
+	}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if err := migrations[0](tx); err != nil {
+			return err
+		}
+		b := tx.Bucket(installationsBucket)
+		for id, v := range installations {
+			if err := b.Put(marshalID(id), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to populate DB: %v", err)
+	}
+	setSchemaVersion(t, db, 1)
+
+	from, _, err := migrateDB(db)
+	if err != nil {
+		t.Fatalf("migrateDB() = %v", err)
+	} else if from != 1 {
+		t.Errorf("migrateDB() from = %v, want 1", from)
+	}
+
+	want := map[int64]bool{1: false, 2: true, 3: false}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(installationsBucket)
+		for id, wantExpiry := range want {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(b.Get(marshalID(id)), &raw); err != nil {
+				return err
+			}
+			if _, ok := raw["srht_token"]; !ok {
+				t.Errorf("installation %v: srht_token has been removed", id)
+			}
+			if _, ok := raw["srht_token_expires_at"]; ok != wantExpiry {
+				t.Errorf("installation %v: has srht_token_expires_at = %v, want %v", id, ok, wantExpiry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	webhookMaxAttempts    = 8
+	webhookRetryBaseDelay = 15 * time.Second
+	webhookRetryMaxDelay  = time.Hour
+	webhookHandleTimeout  = 5 * time.Minute
+	webhookPollInterval   = 10 * time.Second
+)
+
+var (
+	webhookQueueBucket = []byte("webhook_queue")
+	webhookDeadBucket  = []byte("webhook_dead")
+)
+
+// Delivery is a GitHub webhook delivery waiting to be processed.
+type Delivery struct {
+	ID            uint64          `json:"-"`
+	GUID          string          `json:"guid,omitempty"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	ReceivedAt    time.Time       `json:"received_at"`
+	Attempts      int             `json:"attempts,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+}
+
+// EnqueueDelivery stores a delivery in the queue. ErrDuplicate is returned
+// if a delivery with the same GUID has already been enqueued.
+func (db *DB) EnqueueDelivery(delivery *Delivery) error {
+	return db.DB.Update(func(tx *bbolt.Tx) error {
+		if delivery.GUID != "" {
+			if err := markDeliverySeen(tx, delivery.GUID, delivery.ReceivedAt); err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket(webhookQueueBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		delivery.ID = id
+		return putDelivery(b, delivery)
+	})
+}
+
+// ListPendingDeliveries returns queued deliveries which are due for
+// processing at the specified time.
+func (db *DB) ListPendingDeliveries(now time.Time) ([]*Delivery, error) {
+	var l []*Delivery
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).ForEach(func(k, v []byte) error {
+			delivery, err := unmarshalDelivery(k, v)
+			if err != nil {
+				return err
+			}
+			if delivery.NextAttemptAt.After(now) {
+				return nil
+			}
+			l = append(l, delivery)
+			return nil
+		})
+	})
+	return l, err
+}
+
+func (db *DB) ListDeadDeliveries() ([]*Delivery, error) {
+	var l []*Delivery
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhookDeadBucket).ForEach(func(k, v []byte) error {
+			delivery, err := unmarshalDelivery(k, v)
+			if err != nil {
+				return err
+			}
+			l = append(l, delivery)
+			return nil
+		})
+	})
+	return l, err
+}
+
+func (db *DB) CountQueuedDeliveries() (int, error) {
+	var n int
+	err := db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(webhookQueueBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// CompleteDelivery removes a successfully processed delivery from the queue.
+func (db *DB) CompleteDelivery(id uint64) error {
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).Delete(marshalSeq(id))
+	})
+}
+
+// RetryDelivery records a failed attempt to process a delivery. The delivery
+// is moved to the dead-letter bucket once it has been attempted too many
+// times.
+func (db *DB) RetryDelivery(delivery *Delivery, attemptErr error) (dead bool, err error) {
+	delivery.Attempts++
+	delivery.LastError = attemptErr.Error()
+	delivery.NextAttemptAt = time.Now().Add(webhookRetryDelay(delivery.Attempts))
+	dead = delivery.Attempts >= webhookMaxAttempts
+
+	if dead {
+		return true, db.buryDelivery(delivery)
+	}
+	err = db.DB.Update(func(tx *bbolt.Tx) error {
+		return putDelivery(tx.Bucket(webhookQueueBucket), delivery)
+	})
+	return false, err
+}
+
+// AbandonDelivery records a failed attempt to process a delivery and moves it
+// to the dead-letter bucket right away.
+func (db *DB) AbandonDelivery(delivery *Delivery, attemptErr error) error {
+	delivery.Attempts++
+	delivery.LastError = attemptErr.Error()
+	return db.buryDelivery(delivery)
+}
+
+func (db *DB) buryDelivery(delivery *Delivery) error {
+	return db.DB.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(webhookQueueBucket).Delete(marshalSeq(delivery.ID)); err != nil {
+			return err
+		}
+		return putDelivery(tx.Bucket(webhookDeadBucket), delivery)
+	})
+}
+
+func putDelivery(b *bbolt.Bucket, delivery *Delivery) error {
+	buf, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return b.Put(marshalSeq(delivery.ID), buf)
+}
+
+func unmarshalDelivery(k, v []byte) (*Delivery, error) {
+	delivery := &Delivery{ID: binary.BigEndian.Uint64(k)}
+	if err := json.Unmarshal(v, delivery); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook delivery %v: %v", delivery.ID, err)
+	}
+	return delivery, nil
+}
+
+func marshalSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// webhookRetryDelay returns the exponential backoff delay before the next
+// attempt.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBaseDelay
+	for i := 1; i < attempts && delay < webhookRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMaxDelay {
+		delay = webhookRetryMaxDelay
+	}
+	return delay
+}
+
+// webhookQueue processes webhook deliveries stored in the DB with a pool of
+// workers.
+type webhookQueue struct {
+	db      *DB
+	handle  func(ctx context.Context, delivery *Delivery) error
+	workers int
+
+	notify chan struct{}
+
+	mutex    sync.Mutex
+	inFlight map[uint64]struct{}
+}
+
+func newWebhookQueue(db *DB, workers int, handle func(ctx context.Context, delivery *Delivery) error) *webhookQueue {
+	return &webhookQueue{
+		db:       db,
+		handle:   handle,
+		workers:  workers,
+		notify:   make(chan struct{}, 1),
+		inFlight: make(map[uint64]struct{}),
+	}
+}
+
+// Enqueue durably stores a delivery and wakes up the workers.
+func (q *webhookQueue) Enqueue(delivery *Delivery) error {
+	if err := q.db.EnqueueDelivery(delivery); err != nil {
+		return err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run processes deliveries until the context is cancelled, then waits for
+// in-flight deliveries to complete.
+func (q *webhookQueue) Run(ctx context.Context) {
+	ch := make(chan *Delivery)
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range ch {
+				q.process(ctx, delivery)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		deliveries, err := q.db.ListPendingDeliveries(time.Now())
+		if err != nil {
+			log.Printf("failed to list pending webhook deliveries: %v", err)
+		}
+
+		for _, delivery := range deliveries {
+			if !q.markInFlight(delivery.ID) {
+				continue
+			}
+			select {
+			case ch <- delivery:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+
+		select {
+		case <-q.notify:
+		case <-ticker.C:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	close(ch)
+	wg.Wait()
+}
+
+func (q *webhookQueue) markInFlight(id uint64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.inFlight[id]; ok {
+		return false
+	}
+	q.inFlight[id] = struct{}{}
+	return true
+}
+
+func (q *webhookQueue) process(ctx context.Context, delivery *Delivery) {
+	defer func() {
+		q.mutex.Lock()
+		delete(q.inFlight, delivery.ID)
+		q.mutex.Unlock()
+	}()
+
+	panicked, err := q.handleDelivery(ctx, delivery)
+	if panicked {
+		// The delivery would most likely trigger the same panic again
+		if dbErr := q.db.AbandonDelivery(delivery, err); dbErr != nil {
+			log.Printf("failed to update webhook delivery %v: %v", delivery.ID, dbErr)
+		} else {
+			log.Printf("giving up on webhook delivery %v (%v): %v", delivery.ID, delivery.Event, err)
+		}
+		return
+	}
+
+	if err == nil {
+		if err := q.db.CompleteDelivery(delivery.ID); err != nil {
+			log.Printf("failed to remove webhook delivery %v from queue: %v", delivery.ID, err)
+		}
+		return
+	}
+
+	// Don't count attempts interrupted by a shutdown
+	if ctx.Err() != nil {
+		return
+	}
+
+	dead, dbErr := q.db.RetryDelivery(delivery, err)
+	if dbErr != nil {
+		log.Printf("failed to update webhook delivery %v: %v", delivery.ID, dbErr)
+	} else if dead {
+		log.Printf("giving up on webhook delivery %v (%v) after %v attempts: %v", delivery.ID, delivery.Event, delivery.Attempts, err)
+	} else {
+		log.Printf("failed to handle webhook delivery %v (%v), retrying at %v: %v", delivery.ID, delivery.Event, delivery.NextAttemptAt.Format(time.RFC3339), err)
+	}
+}
+
+// handleDelivery calls the delivery handler, recovering from panics.
+func (q *webhookQueue) handleDelivery(ctx context.Context, delivery *Delivery) (panicked bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookHandleTimeout)
+	defer cancel()
+
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("panic while handling webhook delivery %v (%v): %v\n%s", delivery.ID, delivery.Event, v, debug.Stack())
+			err = fmt.Errorf("panic: %v", v)
+			panicked = true
+		}
+	}()
+
+	return false, q.handle(ctx, delivery)
+}
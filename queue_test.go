@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, webhookRetryBaseDelay},
+		{1, webhookRetryBaseDelay},
+		{2, 2 * webhookRetryBaseDelay},
+		{3, 4 * webhookRetryBaseDelay},
+		{8, 128 * webhookRetryBaseDelay},
+		{9, webhookRetryMaxDelay},
+		{100, webhookRetryMaxDelay},
+	}
+	for _, tc := range tests {
+		if got := webhookRetryDelay(tc.attempts); got != tc.want {
+			t.Errorf("webhookRetryDelay(%v) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func enqueueTestDelivery(t *testing.T, db *DB, guid string) *Delivery {
+	t.Helper()
+	delivery := &Delivery{
+		GUID:       guid,
+		Event:      "push",
+		Payload:    []byte("{}"),
+		ReceivedAt: time.Now(),
+	}
+	if err := db.EnqueueDelivery(delivery); err != nil {
+		t.Fatalf("EnqueueDelivery() = %v", err)
+	}
+	return delivery
+}
+
+func checkDeliveryCounts(t *testing.T, db *DB, wantQueued, wantDead int) {
+	t.Helper()
+	if n, err := db.CountQueuedDeliveries(); err != nil {
+		t.Fatalf("CountQueuedDeliveries() = %v", err)
+	} else if n != wantQueued {
+		t.Errorf("CountQueuedDeliveries() = %v, want %v", n, wantQueued)
+	}
+	if l, err := db.ListDeadDeliveries(); err != nil {
+		t.Fatalf("ListDeadDeliveries() = %v", err)
+	} else if len(l) != wantDead {
+		t.Errorf("ListDeadDeliveries() returned %v deliveries, want %v", len(l), wantDead)
+	}
+}
+
+func TestEnqueueDelivery_duplicate(t *testing.T) {
+	db := openMigratedTestDB(t, nil)
+	enqueueTestDelivery(t, db, "a")
+
+	err := db.EnqueueDelivery(&Delivery{GUID: "a", Event: "push", Payload: []byte("{}"), ReceivedAt: time.Now()})
+	if err != ErrDuplicate {
+		t.Errorf("EnqueueDelivery() = %v, want ErrDuplicate", err)
+	}
+	checkDeliveryCounts(t, db, 1, 0)
+}
+
+func TestRetryDelivery(t *testing.T) {
+	db := openMigratedTestDB(t, nil)
+	delivery := enqueueTestDelivery(t, db, "a")
+
+	for i := 1; i < webhookMaxAttempts; i++ {
+		dead, err := db.RetryDelivery(delivery, fmt.Errorf("attempt %v", i))
+		if err != nil {
+			t.Fatalf("RetryDelivery() = %v", err)
+		} else if dead {
+			t.Fatalf("RetryDelivery() buried the delivery after %v attempts", i)
+		}
+	}
+
+	// The delivery must not be retried before its backoff delay
+	if l, err := db.ListPendingDeliveries(time.Now()); err != nil {
+		t.Fatalf("ListPendingDeliveries() = %v", err)
+	} else if len(l) != 0 {
+		t.Errorf("ListPendingDeliveries(now) returned %v deliveries, want 0", len(l))
+	}
+	l, err := db.ListPendingDeliveries(delivery.NextAttemptAt)
+	if err != nil {
+		t.Fatalf("ListPendingDeliveries() = %v", err)
+	} else if len(l) != 1 {
+		t.Fatalf("ListPendingDeliveries(next attempt) returned %v deliveries, want 1", len(l))
+	}
+	if l[0].Attempts != webhookMaxAttempts-1 || l[0].LastError != fmt.Sprintf("attempt %v", webhookMaxAttempts-1) {
+		t.Errorf("stored delivery has attempts = %v, last error = %q", l[0].Attempts, l[0].LastError)
+	}
+
+	dead, err := db.RetryDelivery(delivery, fmt.Errorf("last attempt"))
+	if err != nil {
+		t.Fatalf("RetryDelivery() = %v", err)
+	} else if !dead {
+		t.Errorf("RetryDelivery() didn't bury the delivery after %v attempts", webhookMaxAttempts)
+	}
+	checkDeliveryCounts(t, db, 0, 1)
+}
+
+func TestAbandonDelivery(t *testing.T) {
+	db := openMigratedTestDB(t, nil)
+	delivery := enqueueTestDelivery(t, db, "a")
+	enqueueTestDelivery(t, db, "b")
+
+	if err := db.AbandonDelivery(delivery, fmt.Errorf("invalid payload")); err != nil {
+		t.Fatalf("AbandonDelivery() = %v", err)
+	}
+	checkDeliveryCounts(t, db, 1, 1)
+
+	l, err := db.ListDeadDeliveries()
+	if err != nil {
+		t.Fatalf("ListDeadDeliveries() = %v", err)
+	}
+	if l[0].GUID != "a" || l[0].Attempts != 1 || l[0].LastError != "invalid payload" {
+		t.Errorf("dead delivery = %+v", l[0])
+	}
+}
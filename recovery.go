@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/go-github/v56/github"
+)
+
+// recoveryCursorKey is the meta key holding the ID of the most recent webhook
+// delivery inspected by recoverDeliveries.
+const recoveryCursorKey = "webhook_recovery_cursor"
+
+// recoverDeliveries looks for webhook deliveries which GitHub failed to send
+// to us since the last run (e.g. because hottub was down), and asks GitHub to
+// redeliver them.
+func recoverDeliveries(ctx context.Context, db *DB, agh *github.Client) error {
+	var cursor int64
+	if err := db.GetMeta(recoveryCursorKey, &cursor); err != nil && err != ErrNotFound {
+		return fmt.Errorf("failed to get webhook recovery cursor: %v", err)
+	}
+
+	// Deliveries are listed from newest to oldest
+	var failed []*github.HookDelivery
+	latest := cursor
+	opts := &github.ListCursorOptions{PerPage: 100}
+	done := false
+	for !done {
+		deliveries, resp, err := agh.Apps.ListHookDeliveries(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("failed to list webhook deliveries: %v", err)
+		}
+
+		for _, delivery := range deliveries {
+			id := delivery.GetID()
+			if id > latest {
+				latest = id
+			}
+			// On first run, only initialize the cursor
+			if cursor == 0 || id <= cursor {
+				done = true
+				break
+			}
+
+			// Only retry deliveries which didn't reach us: other errors
+			// such as an invalid signature will occur again
+			if code := delivery.GetStatusCode(); code != 0 && code < 500 {
+				continue
+			}
+			failed = append(failed, delivery)
+		}
+
+		if resp.Cursor == "" {
+			break
+		}
+		opts.Cursor = resp.Cursor
+	}
+
+	// A delivery may have failed once and succeeded on a later attempt
+	redelivered := make(map[string]bool)
+	for _, delivery := range failed {
+		guid := delivery.GetGUID()
+		if redelivered[guid] {
+			continue
+		}
+		if seen, err := db.HasSeenDelivery(guid); err != nil {
+			return err
+		} else if seen {
+			continue
+		}
+
+		if _, _, err := agh.Apps.RedeliverHookDelivery(ctx, delivery.GetID()); err != nil {
+			return fmt.Errorf("failed to redeliver webhook delivery %v: %v", guid, err)
+		}
+		redelivered[guid] = true
+		log.Printf("requested redelivery of missed webhook delivery %v (%v)", guid, delivery.GetEvent())
+	}
+
+	if latest != cursor {
+		if err := db.StoreMeta(recoveryCursorKey, latest); err != nil {
+			return fmt.Errorf("failed to store webhook recovery cursor: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func recoverDeliveriesPeriodically(ctx context.Context, db *DB, agh *github.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := recoverDeliveries(ctx, db, agh); err != nil {
+			log.Printf("failed to recover missed webhook deliveries: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/hottub/buildssrht"
+)
+
+const maxJobLimit = 16
+
+const defaultStatusContext = "builds.sr.ht"
+
+var repoSettingsBucket = []byte("repo_settings")
+
+// Secrets policies decide when secrets are made available to jobs.
+const (
+	SecretsPolicyOwner    = "owner"     // only when the installation owner triggered the build
+	SecretsPolicyNever    = "never"     // never
+	SecretsPolicySameRepo = "same-repo" // except for pull requests from forks
+)
+
+// Fork policies decide whether pull requests from forks are built.
+const (
+	ForkPolicyAlways        = "always"
+	ForkPolicyCollaborators = "collaborators" // only if the author can push to the repository
+	ForkPolicyNever         = "never"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RepoSettings is the configuration of a repository. The zero value holds
+// the defaults.
+type RepoSettings struct {
+	Disabled      bool                  `json:"disabled,omitempty"`
+	JobLimit      int                   `json:"job_limit,omitempty"`
+	Visibility    buildssrht.Visibility `json:"visibility,omitempty"` // ignored for private repositories
+	SecretsPolicy string                `json:"secrets_policy,omitempty"`
+	ForkPolicy    string                `json:"fork_policy,omitempty"`
+	Env           map[string]string     `json:"env,omitempty"`
+	StatusContext string                `json:"status_context,omitempty"`
+	UpdatedBy     string                `json:"updated_by,omitempty"`
+	UpdatedAt     time.Time             `json:"updated_at,omitempty"`
+}
+
+func (settings *RepoSettings) jobLimit() int {
+	if settings.JobLimit > 0 {
+		return settings.JobLimit
+	}
+	return maxJobsPerCheckSuite
+}
+
+func (settings *RepoSettings) statusContext() string {
+	if settings.StatusContext != "" {
+		return settings.StatusContext
+	}
+	return defaultStatusContext
+}
+
+func (settings *RepoSettings) secretsPolicy() string {
+	if settings.SecretsPolicy != "" {
+		return settings.SecretsPolicy
+	}
+	return SecretsPolicyOwner
+}
+
+func (settings *RepoSettings) forkPolicy() string {
+	if settings.ForkPolicy != "" {
+		return settings.ForkPolicy
+	}
+	return ForkPolicyAlways
+}
+
+// GetRepoSettings returns the settings of a repository, or the default
+// settings if none have been stored.
+func (db *DB) GetRepoSettings(repoID int64) (*RepoSettings, error) {
+	settings := new(RepoSettings)
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(repoSettingsBucket).Get(marshalID(repoID))
+		if b == nil {
+			return nil
+		}
+		return json.Unmarshal(b, settings)
+	})
+	return settings, err
+}
+
+func (db *DB) StoreRepoSettings(repoID int64, settings *RepoSettings) error {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return db.DB.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(repoSettingsBucket).Put(marshalID(repoID), b)
+	})
+}
+
+// parseRepoSettingsForm reads settings submitted via the settings page.
+func parseRepoSettingsForm(r *http.Request) (*RepoSettings, error) {
+	settings := &RepoSettings{
+		Disabled:      r.PostFormValue("enabled") == "",
+		Visibility:    buildssrht.Visibility(r.PostFormValue("visibility")),
+		SecretsPolicy: r.PostFormValue("secrets_policy"),
+		ForkPolicy:    r.PostFormValue("fork_policy"),
+		StatusContext: strings.TrimSpace(r.PostFormValue("status_context")),
+	}
+
+	if s := r.PostFormValue("job_limit"); s != "" {
+		var err error
+		settings.JobLimit, err = strconv.Atoi(s)
+		if err != nil || settings.JobLimit < 1 || settings.JobLimit > maxJobLimit {
+			return nil, fmt.Errorf("job limit must be a number between 1 and %v", maxJobLimit)
+		}
+	}
+
+	switch settings.Visibility {
+	case "", buildssrht.VisibilityPublic, buildssrht.VisibilityUnlisted, buildssrht.VisibilityPrivate:
+	default:
+		return nil, fmt.Errorf("invalid visibility %q", settings.Visibility)
+	}
+	switch settings.SecretsPolicy {
+	case "", SecretsPolicyOwner, SecretsPolicyNever, SecretsPolicySameRepo:
+	default:
+		return nil, fmt.Errorf("invalid secrets policy %q", settings.SecretsPolicy)
+	}
+	switch settings.ForkPolicy {
+	case "", ForkPolicyAlways, ForkPolicyCollaborators, ForkPolicyNever:
+	default:
+		return nil, fmt.Errorf("invalid fork policy %q", settings.ForkPolicy)
+	}
+
+	if len(settings.StatusContext) > 100 {
+		return nil, fmt.Errorf("status name is too long")
+	}
+
+	for _, line := range strings.Split(r.PostFormValue("env"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || !envNameRegexp.MatchString(k) {
+			return nil, fmt.Errorf("invalid environment variable %q, expected NAME=value", line)
+		}
+		if k == "BUILD_SUBMITTER" {
+			return nil, fmt.Errorf("environment variable %v is reserved", k)
+		}
+		if settings.Env == nil {
+			settings.Env = make(map[string]string)
+		}
+		settings.Env[k] = v
+	}
+
+	return settings, nil
+}
+
+// formatEnv formats environment variables for the settings page.
+func formatEnv(env map[string]string) string {
+	var lines []string
+	for k, v := range env {
+		lines = append(lines, k+"="+v)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func (srv *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
+	session := srv.requireSession(w, r)
+	if session == nil {
+		return
+	}
+
+	ctx := r.Context()
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "repo")
+
+	// Only repository admins can change settings
+	repo, resp, err := session.GitHub().Repositories.Get(ctx, owner, name)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("failed to fetch repository %v/%v: %v", owner, name, err)
+		http.Error(w, "failed to fetch repository", http.StatusInternalServerError)
+		return
+	}
+	if !repo.GetPermissions()["admin"] {
+		http.Error(w, "only repository admins can change settings", http.StatusForbidden)
+		return
+	}
+
+	_, resp, err = srv.agh.Apps.FindRepositoryInstallation(ctx, repo.GetOwner().GetLogin(), repo.GetName())
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		http.Error(w, "hottub isn't installed on this repository", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("failed to find installation for repository %v: %v", repo.GetFullName(), err)
+		http.Error(w, "failed to find installation", http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := srv.db.GetRepoSettings(repo.GetID())
+	if err != nil {
+		log.Printf("failed to get settings for repository %v: %v", repo.GetFullName(), err)
+		http.Error(w, "failed to get settings", http.StatusInternalServerError)
+		return
+	}
+
+	var formErr error
+	if r.Method == http.MethodPost {
+		if !checkCSRFToken(r) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		var newSettings *RepoSettings
+		newSettings, formErr = parseRepoSettingsForm(r)
+		if formErr == nil {
+			newSettings.UpdatedBy = session.GitHubLogin
+			newSettings.UpdatedAt = time.Now()
+			if err := srv.db.StoreRepoSettings(repo.GetID(), newSettings); err != nil {
+				log.Printf("failed to store settings for repository %v: %v", repo.GetFullName(), err)
+				http.Error(w, "failed to store settings", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("settings of repository %v updated by %v", repo.GetFullName(), session.GitHubLogin)
+			http.Redirect(w, r, r.URL.Path+"?saved=1", http.StatusSeeOther)
+			return
+		}
+	}
+
+	data := struct {
+		Repo                 string
+		Private              bool
+		Settings             *RepoSettings
+		Env                  string
+		Error                error
+		Saved                bool
+		MaxJobLimit          int
+		DefaultJobLimit      int
+		DefaultStatusContext string
+		BadgeURL             string
+		CSRFToken            string
+	}{
+		Repo:                 repo.GetFullName(),
+		Private:              repo.GetPrivate(),
+		Settings:             settings,
+		Env:                  formatEnv(settings.Env),
+		Error:                formErr,
+		Saved:                r.URL.Query().Get("saved") != "",
+		MaxJobLimit:          maxJobLimit,
+		DefaultJobLimit:      maxJobsPerCheckSuite,
+		DefaultStatusContext: defaultStatusContext,
+		BadgeURL:             srv.badgeURL(repo.GetFullName(), repo.GetPrivate()),
+		CSRFToken:            csrfToken(r),
+	}
+	if formErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	srv.renderTemplate(w, "settings.html", &data)
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"git.sr.ht/~emersion/gqlclient"
 	"github.com/emersion/go-oauth2"
@@ -12,6 +17,14 @@ import (
 	"github.com/emersion/hottub/buildssrht"
 )
 
+const (
+	srhtRefreshInterval       = time.Hour
+	srhtRefreshBeforeExpiry   = 15 * 24 * time.Hour
+	srhtRefreshMaxFailures    = 8
+	srhtRefreshRetryBaseDelay = time.Hour
+	srhtRefreshRetryMaxDelay  = 24 * time.Hour
+)
+
 func getSrhtOAuth2Client(metasrhtEndpoint, clientID, clientSecret string) (*oauth2.Client, error) {
 	metadata, err := oauth2.DiscoverServerMetadata(context.Background(), metasrhtEndpoint)
 	if err != nil {
@@ -26,61 +39,356 @@ func getSrhtOAuth2Client(metasrhtEndpoint, clientID, clientSecret string) (*oaut
 }
 
 type SrhtClient struct {
-	GQL      *gqlclient.Client
-	Endpoint string
+	GQL         *gqlclient.Client
+	HTTP        *http.Client // authenticated with the account's token
+	Endpoint    string
+	Credentials *SrhtCredentials
 }
 
-func createSrhtClient(endpoint string, oauth2Client *oauth2.Client, installation *Installation) *SrhtClient {
+func createSrhtClient(endpoint string, oauth2Client *oauth2.Client, creds *SrhtCredentials) *SrhtClient {
 	httpClient := oauth2Client.NewHTTPClient(&oauth2.TokenResp{
-		AccessToken: installation.SrhtToken,
+		AccessToken: creds.SrhtToken,
 		TokenType:   oauth2.TokenTypeBearer,
 	})
 	return &SrhtClient{
-		GQL:      gqlclient.New(endpoint+"/query", httpClient),
-		Endpoint: endpoint,
+		GQL:         gqlclient.New(endpoint+"/query", httpClient),
+		HTTP:        httpClient,
+		Endpoint:    endpoint,
+		Credentials: creds,
 	}
 }
 
-func saveSrhtToken(ctx context.Context, db *DB, srhtEndpoint string, oauth2Client *oauth2.Client, installation *Installation, tokenResp *oauth2.TokenResp) error {
-	populateSrhtInstallation(installation, tokenResp)
-	srht := createSrhtClient(srhtEndpoint, oauth2Client, installation)
+// saveSrhtToken links the sr.ht account owning a token to an installation.
+// The repositories and teams listed in mapping will use this account.
+func saveSrhtToken(ctx context.Context, db *DB, srhtEndpoint string, oauth2Client *oauth2.Client, installation *Installation, tokenResp *oauth2.TokenResp, mapping []string, relink *string) error {
+	var creds SrhtCredentials
+	populateSrhtCredentials(&creds, tokenResp)
+	srht := createSrhtClient(srhtEndpoint, oauth2Client, &creds)
 	user, err := buildssrht.FetchUser(srht.GQL, ctx)
 	if err != nil {
 		return fmt.Errorf("failed to fetch sr.ht user: %v", err)
 	}
+	creds.SrhtUsername = user.CanonicalName
+
+	// Personal tokens don't come with a list of granted scopes
+	creds.SrhtGrants = tokenResp.Scope
+	if len(creds.SrhtGrants) == 0 {
+		creds.SrhtGrants = probeSrhtGrants(ctx, srht)
+	}
+	if missing := creds.MissingGrants(srhtGrants); len(missing) > 0 {
+		log.Printf("sr.ht token for %v is missing grants: %v", user.CanonicalName, strings.Join(missing, " "))
+	}
 
-	if err := db.StoreInstallation(installation); err != nil {
-		return fmt.Errorf("failed to store installation: %v", err)
+	var updated *Installation
+	err = db.UpdateInstallation(installation.ID, func(latest *Installation) error {
+		if relink != nil {
+			if !latest.RelinkSrhtAccount(*relink, &creds) {
+				return fmt.Errorf("sr.ht account %q isn't linked to installation %v", *relink, installation.ID)
+			}
+		} else {
+			latest.LinkSrhtAccount(&creds, mapping)
+		}
+		updated = latest
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update installation: %v", err)
 	}
+	*installation = *updated
 
 	log.Printf("user %v has completed installation %v", user.CanonicalName, installation.ID)
 	return nil
 }
 
-func refreshSrhtToken(ctx context.Context, db *DB, oauth2Client *oauth2.Client, installation *Installation) error {
-	if installation.SrhtRefreshToken == "" || installation.SrhtTokenExpiresAt.IsZero() {
+// probeSrhtGrants discovers the grants of a sr.ht token by performing
+// harmless GraphQL requests. The token is assumed to be valid. nil is returned
+// if the grants can't be determined reliably.
+func probeSrhtGrants(ctx context.Context, srht *SrhtClient) []string {
+	grants := []string{"builds.sr.ht/PROFILE:RO"}
+
+	// There is no read-only way to check for write access: try to cancel a
+	// job which doesn't exist (job IDs start at 1). The request is rejected
+	// before looking up the job if the grant is missing.
+	_, err := buildssrht.CancelJob(srht.GQL, ctx, 0)
+	switch probeSrhtGrant(err) {
+	case srhtGrantGranted:
+		grants = append(grants, "builds.sr.ht/JOBS:RW")
+	case srhtGrantDenied:
+		_, err := buildssrht.ProbeJobs(srht.GQL, ctx)
+		switch probeSrhtGrant(err) {
+		case srhtGrantGranted:
+			grants = append(grants, "builds.sr.ht/JOBS:RO")
+		case srhtGrantUnknown:
+			log.Printf("failed to probe sr.ht token grants: %v", err)
+			return nil
+		}
+	default:
+		log.Printf("failed to probe sr.ht token grants: %v", err)
 		return nil
 	}
-	if time.Until(installation.SrhtTokenExpiresAt) > 15*24*time.Hour {
+
+	_, err = buildssrht.ProbeSecrets(srht.GQL, ctx)
+	switch probeSrhtGrant(err) {
+	case srhtGrantGranted:
+		grants = append(grants, "builds.sr.ht/SECRETS:RO")
+	case srhtGrantUnknown:
+		log.Printf("failed to probe sr.ht token grants: %v", err)
 		return nil
 	}
 
-	tokenResp, err := oauth2Client.Refresh(ctx, installation.SrhtRefreshToken, nil)
+	return grants
+}
+
+// srhtGrantStatus is the outcome of a request performed to check a grant.
+type srhtGrantStatus int
+
+const (
+	srhtGrantUnknown srhtGrantStatus = iota
+	srhtGrantGranted
+	srhtGrantDenied
+)
+
+// probeSrhtGrant interprets the error returned by a sr.ht request performed
+// to check a grant. Errors which don't clearly indicate a missing grant, e.g.
+// network errors, leave the grant unknown.
+func probeSrhtGrant(err error) srhtGrantStatus {
+	if err == nil {
+		return srhtGrantGranted
+	} else if isSrhtAccessDenied(err) {
+		return srhtGrantDenied
+	}
+	return srhtGrantUnknown
+}
+
+// isSrhtAccessDenied checks whether a sr.ht request has been rejected because
+// of missing grants.
+func isSrhtAccessDenied(err error) bool {
+	var httpErr *gqlclient.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusForbidden
+	}
+	var gqlErr *gqlclient.Error
+	if errors.As(err, &gqlErr) {
+		return strings.Contains(strings.ToLower(gqlErr.Message), "access denied")
+	}
+	return false
+}
+
+// srhtRefreshMutex serializes token refreshes, since refresh tokens can only
+// be used once. Other changes to installations don't need to hold it: they
+// are performed with DB.UpdateInstallation.
+var srhtRefreshMutex sync.Mutex
+
+func needsSrhtTokenRefresh(creds *SrhtCredentials, now time.Time) bool {
+	if creds.SrhtRefreshToken == "" || creds.SrhtTokenExpiresAt.IsZero() || creds.SrhtNeedsReauth {
+		return false
+	}
+	if creds.SrhtTokenExpiresAt.Sub(now) > srhtRefreshBeforeExpiry {
+		return false
+	}
+	return !now.Before(creds.SrhtNextRefreshAt)
+}
+
+// refreshSrhtToken refreshes a sr.ht token if it's about to expire. Failed
+// attempts are retried with exponential backoff, and the credentials are
+// marked as needing re-authorization once the token can't be refreshed.
+func refreshSrhtToken(ctx context.Context, db *DB, oauth2Client *oauth2.Client, installation *Installation, creds *SrhtCredentials) error {
+	if !needsSrhtTokenRefresh(creds, time.Now()) {
+		return nil
+	}
+
+	srhtRefreshMutex.Lock()
+	defer srhtRefreshMutex.Unlock()
+
+	// Another goroutine may have refreshed the token in the meantime
+	latest, err := db.GetInstallation(installation.ID)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get installation: %v", err)
+	}
+	latestCreds := latest.srhtCredentialsByUsername(creds.SrhtUsername)
+	if latestCreds == nil {
+		return fmt.Errorf("sr.ht account %v has been unlinked", creds.SrhtUsername)
 	}
+	if !needsSrhtTokenRefresh(latestCreds, time.Now()) {
+		*creds = *latestCreds
+		return nil
+	}
+
+	refreshToken := latestCreds.SrhtRefreshToken
+	tokenResp, refreshErr := oauth2Client.Refresh(ctx, refreshToken, nil)
 
-	populateSrhtInstallation(installation, tokenResp)
-	if err := db.StoreInstallation(installation); err != nil {
-		return fmt.Errorf("failed to store installation: %v", err)
+	// Only update the refreshed account: the rest of the installation may
+	// have changed during the request
+	err = db.UpdateInstallation(installation.ID, func(latest *Installation) error {
+		latestCreds := latest.srhtCredentialsByUsername(creds.SrhtUsername)
+		if latestCreds == nil || latestCreds.SrhtRefreshToken != refreshToken {
+			return fmt.Errorf("sr.ht account %v has been unlinked or re-linked during token refresh", creds.SrhtUsername)
+		}
+
+		if refreshErr != nil {
+			latestCreds.SrhtRefreshFailures++
+			latestCreds.SrhtRefreshError = refreshErr.Error()
+			latestCreds.SrhtNextRefreshAt = time.Now().Add(srhtRefreshRetryDelay(latestCreds.SrhtRefreshFailures))
+			if latestCreds.SrhtRefreshFailures >= srhtRefreshMaxFailures || time.Now().After(latestCreds.SrhtTokenExpiresAt) {
+				latestCreds.SrhtNeedsReauth = true
+				log.Printf("sr.ht token of %v for installation %v needs re-authorization", latestCreds.SrhtUsername, installation.ID)
+			}
+		} else {
+			populateSrhtCredentials(latestCreds, tokenResp)
+			if len(tokenResp.Scope) > 0 {
+				latestCreds.SrhtGrants = tokenResp.Scope
+			}
+		}
+
+		*creds = *latestCreds
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update installation: %v", err)
 	}
 
+	if refreshErr != nil {
+		return refreshErr
+	}
 	log.Printf("refreshed sr.ht token for installation %v", installation.ID)
 	return nil
 }
 
-func populateSrhtInstallation(installation *Installation, tokenResp *oauth2.TokenResp) {
-	installation.SrhtToken = tokenResp.AccessToken
-	installation.SrhtRefreshToken = tokenResp.RefreshToken
-	installation.SrhtTokenExpiresAt = time.Now().Add(tokenResp.ExpiresIn)
+// isSrhtAuthFailure checks whether a sr.ht request has been rejected because
+// the token is invalid, e.g. because it has been revoked or has expired.
+func isSrhtAuthFailure(err error) bool {
+	var httpErr *gqlclient.HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized
+}
+
+// isSrhtForbidden checks whether a sr.ht request has been rejected because the
+// token doesn't allow it. The token may still be valid for other requests.
+func isSrhtForbidden(err error) bool {
+	var httpErr *gqlclient.HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusForbidden
+}
+
+// markSrhtNeedsReauth records that a sr.ht account needs to be linked again.
+func markSrhtNeedsReauth(db *DB, installationID int64, creds *SrhtCredentials) error {
+	creds.SrhtNeedsReauth = true
+
+	updated := false
+	err := db.UpdateInstallation(installationID, func(installation *Installation) error {
+		// The token may have been replaced in the meantime
+		latest := installation.srhtCredentialsByUsername(creds.SrhtUsername)
+		if latest == nil || latest.SrhtToken != creds.SrhtToken || latest.SrhtNeedsReauth {
+			return nil
+		}
+		latest.SrhtNeedsReauth = true
+		updated = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update installation: %v", err)
+	} else if !updated {
+		return nil
+	}
+
+	log.Printf("sr.ht token of %v for installation %v needs re-authorization", creds.SrhtUsername, installationID)
+	return nil
+}
+
+// srhtRefreshRetryDelay returns the exponential backoff delay before the next
+// token refresh attempt.
+func srhtRefreshRetryDelay(failures int) time.Duration {
+	delay := srhtRefreshRetryBaseDelay
+	for i := 1; i < failures && delay < srhtRefreshRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > srhtRefreshRetryMaxDelay {
+		delay = srhtRefreshRetryMaxDelay
+	}
+	return delay
+}
+
+// refreshSrhtTokensPeriodically refreshes tokens which are about to expire,
+// including the ones belonging to inactive installations.
+func refreshSrhtTokensPeriodically(ctx context.Context, db *DB, oauth2Client *oauth2.Client) {
+	ticker := time.NewTicker(srhtRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		installations, err := db.ListInstallations()
+		if err != nil {
+			log.Printf("failed to list installations: %v", err)
+		}
+
+		now := time.Now()
+		for _, installation := range installations {
+			installation.forEachSrhtCredentials(func(creds *SrhtCredentials) error {
+				if !needsSrhtTokenRefresh(creds, now) {
+					return nil
+				}
+				if err := refreshSrhtToken(ctx, db, oauth2Client, installation, creds); err != nil {
+					log.Printf("failed to refresh sr.ht token of %v for installation %v: %v", creds.SrhtUsername, installation.ID, err)
+				}
+				return nil
+			})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func populateSrhtCredentials(creds *SrhtCredentials, tokenResp *oauth2.TokenResp) {
+	creds.SrhtToken = tokenResp.AccessToken
+	creds.SrhtRefreshToken = tokenResp.RefreshToken
+	creds.SrhtTokenExpiresAt = time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		creds.SrhtTokenExpiresAt = time.Now().Add(tokenResp.ExpiresIn)
+	}
+}
+
+// srhtAccountStatus describes a sr.ht account linked to an installation.
+type srhtAccountStatus struct {
+	*SrhtCredentials
+	Default  bool
+	Warnings []string
+}
+
+func listSrhtAccounts(installation *Installation) []srhtAccountStatus {
+	var l []srhtAccountStatus
+	installation.forEachSrhtCredentials(func(creds *SrhtCredentials) error {
+		if creds.SrhtToken == "" {
+			return nil
+		}
+
+		var warnings []string
+		if creds.SrhtNeedsReauth {
+			warnings = append(warnings, "The token can't be used anymore, the account needs to be linked again.")
+		} else if creds.SrhtRefreshError != "" {
+			warnings = append(warnings, "Failed to refresh the token: "+creds.SrhtRefreshError)
+		}
+		if !creds.HasGrant("builds.sr.ht/JOBS:RW") {
+			warnings = append(warnings, "The token is missing the builds.sr.ht/JOBS:RW grant, jobs can't be submitted.")
+		}
+		if !creds.HasGrant(srhtGrantsSecrets) {
+			warnings = append(warnings, "The token is missing the "+srhtGrantsSecrets+" grant, secrets are unavailable to jobs.")
+		}
+
+		l = append(l, srhtAccountStatus{
+			SrhtCredentials: creds,
+			Default:         creds == &installation.SrhtCredentials,
+			Warnings:        warnings,
+		})
+		return nil
+	})
+	return l
+}
+
+// parseSrhtMapping parses a list of repository names and team slugs
+// separated by spaces or commas.
+func parseSrhtMapping(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v56/github"
+)
+
+// mergeQueueBranchPrefix is the prefix of the temporary branches created by
+// GitHub merge queues.
+const mergeQueueBranchPrefix = "gh-readonly-queue/"
+
+// handleDelivery processes a webhook delivery taken from the queue.
+func (srv *Server) handleDelivery(ctx context.Context, delivery *Delivery) error {
+	event, err := github.ParseWebHook(delivery.Event, delivery.Payload)
+	if err != nil {
+		// Retrying won't help
+		log.Printf("failed to parse webhook payload: %v", err)
+		return nil
+	}
+
+	if err := srv.handleEvent(ctx, event); err != nil {
+		return fmt.Errorf("failed to handle event %T: %v", event, err)
+	}
+	return nil
+}
+
+func (srv *Server) handleEvent(ctx context.Context, event interface{}) error {
+	var err error
+	switch event := event.(type) {
+	case *github.PingEvent:
+		log.Printf("received ping (%v)", *event.Zen)
+	case *github.InstallationEvent:
+		log.Printf("installation %v by %v", event.GetAction(), event.Sender.GetLogin())
+		switch event.GetAction() {
+		case "created":
+			owner := event.Sender.GetLogin()
+			org := event.Installation.GetAccount().GetLogin()
+			if org == owner {
+				org = ""
+			}
+			err = srv.db.StoreInstallation(&Installation{
+				ID:          *event.Installation.ID,
+				CreatedAt:   time.Now(),
+				Owner:       owner,
+				Org:         org,
+				Permissions: installationPermissions(event.Installation),
+			})
+		case "deleted":
+			err = srv.db.DeleteInstallation(*event.Installation.ID)
+		case "suspend", "unsuspend":
+			suspended := event.GetAction() == "suspend"
+			err = srv.db.UpdateInstallation(*event.Installation.ID, func(installation *Installation) error {
+				installation.Suspended = suspended
+				return nil
+			})
+			if err != nil {
+				break
+			}
+
+			// GitHub rejects API calls made on behalf of a suspended
+			// installation, so stop reporting statuses until the
+			// installation is unsuspended
+			if suspended {
+				activeJobs.cancelInstallation(ctx, *event.Installation.ID)
+			} else {
+				err = srv.resumeJobs(ctx, *event.Installation.ID)
+			}
+		case "new_permissions_accepted":
+			err = srv.db.UpdateInstallation(*event.Installation.ID, func(installation *Installation) error {
+				installation.Permissions = installationPermissions(event.Installation)
+				return nil
+			})
+		}
+	case *github.InstallationRepositoriesEvent:
+		log.Printf("installation repositories %v by %v (%v added, %v removed)", event.GetAction(), event.Sender.GetLogin(), len(event.RepositoriesAdded), len(event.RepositoriesRemoved))
+	case *github.CheckSuiteEvent:
+		if *event.Action != "requested" && *event.Action != "rerequested" {
+			break
+		}
+		err = srv.handleCheckSuite(ctx, event.Installation, event.Repo, event.Sender, event.CheckSuite, event.GetAction() == "rerequested")
+	case *github.MergeGroupEvent:
+		if event.GetAction() != "checks_requested" {
+			break
+		}
+
+		var suiteCtx *checkSuiteContext
+		suiteCtx, err = srv.newCheckSuiteContext(ctx, event.Installation, event.Repo, event.Sender)
+		if err != nil || suiteCtx == nil {
+			break
+		}
+
+		// Build the temporary merge branch, and report results on its head
+		suiteCtx.headRepo = event.Repo
+		suiteCtx.headCommit = event.MergeGroup.HeadCommit
+		suiteCtx.headSHA = event.MergeGroup.GetHeadSHA()
+		suiteCtx.mergeGroup = event.MergeGroup
+
+		if suiteCtx.headCommit == nil {
+			if err = suiteCtx.fetchHeadCommit(); err != nil {
+				break
+			}
+		}
+
+		err = startCheckSuite(suiteCtx)
+	case *github.CheckRunEvent:
+		// Re-running a single check run from GitHub re-runs the whole check
+		// suite
+		if event.GetAction() != "rerequested" || event.CheckRun.GetCheckSuite() == nil {
+			break
+		}
+		err = srv.handleCheckSuite(ctx, event.Installation, event.Repo, event.Sender, event.CheckRun.CheckSuite, true)
+	case *github.PullRequestEvent:
+		// GitHub doesn't automatically create a CheckSuiteEvent for pull
+		// requests made from a fork, so we need to manually handle this
+		// case:
+		// https://github.community/t/no-check-suite-event-for-foreign-pull-reuqests/13915/2
+		if *event.Action != "opened" && *event.Action != "reopened" && *event.Action != "synchronize" {
+			break
+		}
+		if event.PullRequest.Head.Repo == nil {
+			log.Printf("ignoring pull request from deleted fork for %v", event.Repo.GetFullName())
+			break
+		}
+		if event.PullRequest.Head.Repo.GetFullName() == event.PullRequest.Base.Repo.GetFullName() {
+			break
+		}
+
+		var suiteCtx *checkSuiteContext
+		suiteCtx, err = srv.newCheckSuiteContext(ctx, event.Installation, event.Repo, event.Sender)
+		if err != nil || suiteCtx == nil {
+			break
+		}
+
+		switch suiteCtx.settings.forkPolicy() {
+		case ForkPolicyNever:
+			log.Printf("ignoring pull request from fork for %v", event.Repo.GetFullName())
+			return nil
+		case ForkPolicyCollaborators:
+			author := event.PullRequest.GetUser().GetLogin()
+			var ok bool
+			ok, err = hasWriteAccess(ctx, suiteCtx.gh, event.Repo.GetOwner().GetLogin(), event.Repo.GetName(), author)
+			if err != nil {
+				err = fmt.Errorf("failed to check permissions of %v: %v", author, err)
+			} else if !ok {
+				log.Printf("ignoring pull request from fork by %v for %v", author, event.Repo.GetFullName())
+				return nil
+			}
+		}
+		if err != nil {
+			break
+		}
+
+		suiteCtx.headRepo = event.PullRequest.Head.Repo
+		suiteCtx.headSHA = event.PullRequest.Head.GetSHA()
+		suiteCtx.pullRequest = event.PullRequest
+		if err = suiteCtx.fetchHeadCommit(); err != nil {
+			break
+		}
+
+		err = startCheckSuite(suiteCtx)
+	default:
+		log.Printf("unhandled event type: %T", event)
+	}
+
+	return err
+}
+
+// handleCheckSuite builds the head commit of a check suite. If rerequested is
+// set, recently submitted jobs aren't re-used.
+func (srv *Server) handleCheckSuite(ctx context.Context, ghInstallation *github.Installation, repo *github.Repository, sender *github.User, suite *github.CheckSuite, rerequested bool) error {
+	// Merge queue branches are built when receiving the MergeGroupEvent
+	if strings.HasPrefix(suite.GetHeadBranch(), mergeQueueBranchPrefix) {
+		return nil
+	}
+
+	suiteCtx, err := srv.newCheckSuiteContext(ctx, ghInstallation, repo, sender)
+	if err != nil || suiteCtx == nil {
+		return err
+	}
+
+	suiteCtx.headRepo = repo
+	suiteCtx.headCommit = suite.HeadCommit
+	suiteCtx.headSHA = suite.GetHeadSHA()
+	// Re-running checks from GitHub must not re-use the previous jobs
+	suiteCtx.forceBuild = rerequested
+	if len(suite.PullRequests) == 1 {
+		suiteCtx.pullRequest = suite.PullRequests[0]
+	} else if len(suite.PullRequests) == 0 && suite.HeadBranch != nil {
+		suiteCtx.headBranch = *suite.HeadBranch
+	}
+
+	// The check suite of check run events doesn't include the head commit
+	if suiteCtx.headCommit == nil {
+		if err := suiteCtx.fetchHeadCommit(); err != nil {
+			return err
+		}
+	}
+
+	return startCheckSuite(suiteCtx)
+}
+
+// newCheckSuiteContext prepares a checkSuiteContext to build commits for a
+// repository. nil is returned if builds are disabled for the installation.
+func (srv *Server) newCheckSuiteContext(ctx context.Context, ghInstallation *github.Installation, baseRepo *github.Repository, sender *github.User) (*checkSuiteContext, error) {
+	installation, err := srv.db.GetInstallation(ghInstallation.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if installation.Suspended {
+		log.Printf("ignoring event for suspended installation %v", installation.ID)
+		return nil, nil
+	}
+	if installation.Disabled {
+		log.Printf("ignoring event for disabled installation %v", installation.ID)
+		return nil, nil
+	}
+
+	settings, err := srv.db.GetRepoSettings(baseRepo.GetID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository settings: %v", err)
+	}
+	if settings.Disabled {
+		log.Printf("ignoring event for disabled repository %v", baseRepo.GetFullName())
+		return nil, nil
+	}
+
+	gh := srv.github.installationClient(ghInstallation.GetID())
+
+	var teams []string
+	if installation.hasTeamMapping() {
+		teams, err = listRepoTeams(ctx, gh, baseRepo.Owner.GetLogin(), baseRepo.GetName())
+		if err != nil {
+			log.Printf("failed to list teams for repository %v: %v", baseRepo.GetFullName(), err)
+		}
+	}
+	creds := installation.SrhtCredentialsFor(baseRepo.GetName(), teams)
+
+	if err := refreshSrhtToken(ctx, srv.db, srv.srhtOAuth2Client, installation, creds); err != nil {
+		log.Printf("failed to refresh sr.ht token for installation %v: %v", installation.ID, err)
+	}
+
+	return &checkSuiteContext{
+		Context:        ctx,
+		srv:            srv,
+		gh:             gh,
+		srht:           createSrhtClient(srv.buildssrhtEndpoint, srv.srhtOAuth2Client, creds),
+		installation:   installation,
+		settings:       settings,
+		baseRepo:       baseRepo,
+		sender:         sender.GetLogin(),
+		ownerSubmitted: sender.GetLogin() == installation.Owner,
+	}, nil
+}